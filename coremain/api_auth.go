@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+// readOnlyAPIs are api paths that read-only tokens can access with
+// GET or HEAD requests. A path that ends with "/" matches all paths
+// under it.
+// Plugin apis are not included because some of them modify plugins
+// with GET requests (e.g. cache /flush).
+var readOnlyAPIs = []string{
+	"/metrics",
+	"/health/",
+	"/graph",
+	"/log/level",
+	"/log/level/plugins",
+}
+
+type tokenScope int
+
+const (
+	scopeNone tokenScope = iota
+	scopeReadOnly
+	scopeFull
+)
+
+type apiAuth struct {
+	tokens         [][]byte
+	readOnlyTokens [][]byte
+}
+
+// newAPIAuth returns a nil apiAuth if no token is configured.
+func newAPIAuth(cfg *APIConfig) (*apiAuth, error) {
+	if len(cfg.Tokens)+len(cfg.ReadOnlyTokens) == 0 {
+		return nil, nil
+	}
+	a := new(apiAuth)
+	for _, t := range cfg.Tokens {
+		if len(t) == 0 {
+			return nil, errors.New("empty api token")
+		}
+		a.tokens = append(a.tokens, []byte(t))
+	}
+	for _, t := range cfg.ReadOnlyTokens {
+		if len(t) == 0 {
+			return nil, errors.New("empty api read-only token")
+		}
+		a.readOnlyTokens = append(a.readOnlyTokens, []byte(t))
+	}
+	return a, nil
+}
+
+func (a *apiAuth) scope(req *http.Request) tokenScope {
+	t, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return scopeNone
+	}
+	b := []byte(strings.TrimSpace(t))
+	match := func(tokens [][]byte) bool {
+		for _, token := range tokens {
+			if subtle.ConstantTimeCompare(b, token) == 1 {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case match(a.tokens):
+		return scopeFull
+	case match(a.readOnlyTokens):
+		return scopeReadOnly
+	default:
+		return scopeNone
+	}
+}
+
+func isReadOnlyAPI(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, p := range readOnlyAPIs {
+		if req.URL.Path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(req.URL.Path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler returns a http.Handler that checks the bearer token before
+// passing the request to next.
+func (a *apiAuth) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch a.scope(req) {
+		case scopeFull:
+		case scopeReadOnly:
+			if !isReadOnlyAPI(req) {
+				http.Error(w, "read-only token can not access this api", http.StatusForbidden)
+				return
+			}
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mosdns"`)
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// newAPITLSConfig returns a nil tls.Config if TLS is not configured.
+func newAPITLSConfig(cfg *APIConfig) (*tls.Config, error) {
+	if len(cfg.Cert)+len(cfg.Key) == 0 {
+		if len(cfg.ClientCA) > 0 {
+			return nil, errors.New("api client_ca requires cert and key")
+		}
+		return nil, nil
+	}
+	if len(cfg.Cert) == 0 || len(cfg.Key) == 0 {
+		return nil, errors.New("api requires both cert and key")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api cert, %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if len(cfg.ClientCA) > 0 {
+		pool, err := utils.LoadCertPool(cfg.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load api client ca, %w", err)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
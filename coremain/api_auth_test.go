@@ -0,0 +1,65 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_apiAuth(t *testing.T) {
+	a, err := newAPIAuth(&APIConfig{Tokens: []string{"full"}, ReadOnlyTokens: []string{"ro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{"no token", http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{"bad token", http.MethodGet, "/metrics", "bad", http.StatusUnauthorized},
+		{"full", http.MethodPost, "/reload", "full", http.StatusOK},
+		{"full plugin api", http.MethodGet, "/plugins/c/flush", "full", http.StatusOK},
+		{"ro metrics", http.MethodGet, "/metrics", "ro", http.StatusOK},
+		{"ro health", http.MethodGet, "/health/ready", "ro", http.StatusOK},
+		{"ro reload", http.MethodPost, "/reload", "ro", http.StatusForbidden},
+		{"ro plugin api", http.MethodGet, "/plugins/c/flush", "ro", http.StatusForbidden},
+		{"ro metrics post", http.MethodPost, "/metrics", "ro", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if len(tt.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/pkg/safe_close"
+	"github.com/go-chi/chi/v5"
+)
+
+// CheckConfig loads the config from file and builds all its plugins
+// in dry run mode. See Mosdns.DryRun.
+// Unlike NewMosdns, it does not stop at the first error. It returns all
+// errors found, each of them contains the file and the index of the plugin.
+// The built plugins are closed before CheckConfig returns.
+func CheckConfig(file string) []error {
+	m, errs := newDryRunMosdns(file)
+	if m != nil {
+		m.closePluginsExcept(nil)
+	}
+	return errs
+}
+
+// newDryRunMosdns builds plugins from file in dry run mode.
+// It returns a nil Mosdns if file cannot be loaded.
+func newDryRunMosdns(file string) (*Mosdns, []error) {
+	cfg, fileUsed, err := loadConfig(file)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	sh := &shared{
+		httpMux:    chi.NewRouter(),
+		metricsReg: newMetricsReg(),
+		sc:         safe_close.NewSafeClose(),
+	}
+	m := newMosdns(mlog.Nop(), sh)
+	m.dryRun = true
+	sh.cur.Store(m)
+
+	if _, err := newAPIAuth(&cfg.API); err != nil {
+		m.checkErrs = append(m.checkErrs, withFile(fileUsed, fmt.Errorf("invalid api config: %w", err)))
+	}
+	if _, err := newAPITLSConfig(&cfg.API); err != nil {
+		m.checkErrs = append(m.checkErrs, withFile(fileUsed, fmt.Errorf("invalid api config: %w", err)))
+	}
+
+	if err := m.loadPresetPlugins(); err != nil {
+		m.checkErrs = append(m.checkErrs, err)
+	}
+	if err := m.loadPluginsFromCfg(cfg, fileUsed); err != nil {
+		m.checkErrs = append(m.checkErrs, withFile(fileUsed, err))
+	}
+	return m, m.checkErrs
+}
+
+// DryRun reports whether m is built by CheckConfig.
+// In dry run mode, plugins should validate their args and
+// references to other plugins as usual, but must not bind sockets,
+// start servers or change the system and files.
+func (m *Mosdns) DryRun() bool {
+	return m.dryRun
+}
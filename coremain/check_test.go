@@ -0,0 +1,128 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type listenTestArgs struct {
+	Addr string `yaml:"addr"`
+}
+
+func init() {
+	// _listen_test listens on addr like a server plugin.
+	RegNewPluginFunc("_listen_test", func(bp *BP, args any) (any, error) {
+		if bp.M().DryRun() {
+			return struct{}{}, nil
+		}
+		return net.Listen("tcp", args.(*listenTestArgs).Addr)
+	}, func() any { return new(listenTestArgs) })
+}
+
+func writeTestConfig(t *testing.T, cfg string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      string
+		wantErrs []string
+	}{
+		{
+			name: "valid",
+			cfg: `
+plugins:
+  - {tag: a, type: _ref_test, args: {refs: [b]}}
+  - {tag: b, type: _ref_test}
+`,
+		},
+		{
+			name: "invalid arg",
+			cfg: `
+plugins:
+  - {tag: a, type: _ref_test, args: {refs: {b: 1}}}
+`,
+			wantErrs: []string{"failed to init plugin #0 a"},
+		},
+		{
+			name: "missing tag",
+			cfg: `
+plugins:
+  - {tag: a, type: _ref_test, args: {refs: [b]}}
+  - {tag: c, type: _ref_test, args: {refs: [d]}}
+`,
+			wantErrs: []string{"can not find b", "can not find d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeTestConfig(t, tt.cfg)
+			errs := CheckConfig(file)
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("CheckConfig() errors = %v, want %d errors", errs, len(tt.wantErrs))
+			}
+			for i, err := range errs {
+				if !strings.Contains(err.Error(), tt.wantErrs[i]) {
+					t.Errorf("error #%d = %v, want %s", i, err, tt.wantErrs[i])
+				}
+				if !strings.Contains(err.Error(), file) {
+					t.Errorf("error #%d = %v, should contain the file", i, err)
+				}
+			}
+		})
+	}
+}
+
+// Plugins and the api must not bind sockets in dry run mode.
+func TestCheckConfig_noListen(t *testing.T) {
+	// Hold the address, so binding it again fails.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	file := writeTestConfig(t, fmt.Sprintf(`
+api: {http: "%[1]s"}
+plugins:
+  - {tag: server, type: _listen_test, args: {addr: "%[1]s"}}
+`, addr))
+	if errs := CheckConfig(file); len(errs) != 0 {
+		t.Fatalf("CheckConfig() errors = %v", errs)
+	}
+
+	// Make sure the config does bind the address without dry run.
+	if _, err := NewTestMosdnsFromFile(file); err == nil {
+		t.Fatal("want address in use error without dry run")
+	}
+}
@@ -20,14 +20,78 @@
 package coremain
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 )
 
 type Config struct {
-	Log     mlog.LogConfig `yaml:"log"`
-	Include []string       `yaml:"include"`
-	Plugins []PluginConfig `yaml:"plugins"`
-	API     APIConfig      `yaml:"api"`
+	Log     mlog.LogConfig  `yaml:"log"`
+	Include []IncludeConfig `yaml:"include"`
+	Plugins []PluginConfig  `yaml:"plugins"`
+	API     APIConfig       `yaml:"api"`
+
+	// DrainTimeout is the maximum time in seconds to wait for queries
+	// that are being handled before closing plugins on shutdown and
+	// reload. Default is 10.
+	DrainTimeout int `yaml:"drain_timeout"`
+}
+
+// IncludeConfig is an include entry. It can also be a string, which is
+// the Path.
+type IncludeConfig struct {
+	// Path of config files. It can be a glob pattern, e.g. "conf.d/*.yaml".
+	// Matched files are loaded in lexical order.
+	Path string `yaml:"path"`
+
+	// Namespace is optional. If set, tags of plugins in the included files
+	// are prefixed with "namespace.". Plugins in these files can refer to
+	// each other by their local tags, other files can refer to them by
+	// "namespace.tag". Namespaces of nested includes are joined.
+	Namespace string `yaml:"namespace"`
+}
+
+// files returns the files that c.Path matches.
+func (c *IncludeConfig) files() ([]string, error) {
+	if len(c.Path) == 0 {
+		return nil, errors.New("empty include path")
+	}
+	if strings.Contains(c.Namespace, ".") {
+		return nil, fmt.Errorf("invalid namespace %s, it must not contain '.'", c.Namespace)
+	}
+	if !strings.ContainsAny(c.Path, `*?[`) { // not a pattern
+		return []string{c.Path}, nil
+	}
+	files, err := filepath.Glob(c.Path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %s, %w", c.Path, err)
+	}
+	return files, nil
+}
+
+// namespace returns the namespace of included files. parent is the
+// namespace of the file that includes them.
+func (c *IncludeConfig) namespace(parent string) string {
+	switch {
+	case len(c.Namespace) == 0:
+		return parent
+	case len(parent) == 0:
+		return c.Namespace
+	default:
+		return parent + "." + c.Namespace
+	}
+}
+
+// includeDecodeHook decodes a string to an IncludeConfig.
+func includeDecodeHook(from reflect.Type, to reflect.Type, data any) (any, error) {
+	if to == reflect.TypeOf(IncludeConfig{}) && from.Kind() == reflect.String {
+		return IncludeConfig{Path: data.(string)}, nil
+	}
+	return data, nil
 }
 
 // PluginConfig represents a plugin config
@@ -47,4 +111,18 @@ type PluginConfig struct {
 
 type APIConfig struct {
 	HTTP string `yaml:"http"`
+
+	// TLS. If Cert and Key are set, the api server serves https.
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA enables mTLS. Clients must present a certificate
+	// that is signed by one of these CAs. Requires Cert and Key.
+	ClientCA []string `yaml:"client_ca"`
+
+	// Bearer tokens. If any token is set, requests must have a
+	// "Authorization: Bearer <token>" header.
+	// Tokens have full access to the api.
+	Tokens []string `yaml:"tokens"`
+	// ReadOnlyTokens can only access read-only apis. See readOnlyAPIs.
+	ReadOnlyTokens []string `yaml:"read_only_tokens"`
 }
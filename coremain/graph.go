@@ -0,0 +1,224 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ServerPlugin is a plugin that receives queries from clients, e.g. udp_server.
+// Server plugins are the roots of the plugin graph.
+type ServerPlugin interface {
+	// ListenAddr returns the configured listen address of the server.
+	ListenAddr() string
+}
+
+// PluginGraph is the dependency graph of plugins.
+// An edge from A to B means plugin A got plugin B during its init.
+type PluginGraph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+
+	// Cycles contains plugins that depend on each other.
+	Cycles [][]string `json:"cycles,omitempty"`
+}
+
+type GraphNode struct {
+	Tag    string `json:"tag"`
+	Type   string `json:"type,omitempty"`
+	Listen string `json:"listen,omitempty"` // Only for server plugins.
+
+	// Unused is true if this plugin is configured, is not a server and
+	// is not referenced by any other plugin.
+	Unused bool `json:"unused,omitempty"`
+}
+
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Graph returns the dependency graph of plugins in m.
+func (m *Mosdns) Graph() *PluginGraph {
+	g := new(PluginGraph)
+	referenced := make(map[string]bool)
+	for _, tag := range m.order {
+		for _, dep := range m.deps[tag] {
+			g.Edges = append(g.Edges, GraphEdge{From: tag, To: dep})
+			if dep != tag {
+				referenced[dep] = true
+			}
+		}
+	}
+	for _, tag := range m.order {
+		c, configured := m.pluginCfgs[tag] // preset plugins are not configured.
+		n := GraphNode{Tag: tag, Type: c.Type}
+		if s, ok := m.plugins[tag].(ServerPlugin); ok {
+			n.Listen = s.ListenAddr()
+		} else {
+			n.Unused = configured && !referenced[tag]
+		}
+		g.Nodes = append(g.Nodes, n)
+	}
+	g.Cycles = findCycles(m.order, m.deps)
+	return g
+}
+
+// findCycles returns strongly connected components that have more than
+// one node or have a self-loop. It uses Tarjan's algorithm.
+func findCycles(nodes []string, deps map[string][]string) [][]string {
+	var (
+		index   = 0
+		indexes = make(map[string]int)
+		lowLink = make(map[string]int)
+		onStack = make(map[string]bool)
+		stack   []string
+		cycles  [][]string
+	)
+
+	var strongConnect func(v string)
+	strongConnect = func(v string) {
+		indexes[v] = index
+		lowLink[v] = index
+		index++
+		stack = append(stack, v)
+		onStack[v] = true
+
+		selfLoop := false
+		for _, w := range deps[v] {
+			if w == v {
+				selfLoop = true
+			}
+			if _, visited := indexes[w]; !visited {
+				strongConnect(w)
+				lowLink[v] = min(lowLink[v], lowLink[w])
+			} else if onStack[w] {
+				lowLink[v] = min(lowLink[v], indexes[w])
+			}
+		}
+
+		if lowLink[v] == indexes[v] {
+			var scc []string
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				scc = append(scc, w)
+				if w == v {
+					break
+				}
+			}
+			if len(scc) > 1 || selfLoop {
+				cycles = append(cycles, scc)
+			}
+		}
+	}
+
+	for _, v := range nodes {
+		if _, visited := indexes[v]; !visited {
+			strongConnect(v)
+		}
+	}
+	return cycles
+}
+
+// WriteDOT writes g in Graphviz DOT format.
+// Server plugins are drawn as boxes, unused plugins are dashed and
+// edges in cycles are red.
+func (g *PluginGraph) WriteDOT(w io.Writer) error {
+	inCycle := make(map[string]int)
+	for i, c := range g.Cycles {
+		for _, tag := range c {
+			inCycle[tag] = i + 1
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("digraph mosdns {\n")
+	for _, n := range g.Nodes {
+		label := n.Tag
+		if len(n.Type) > 0 {
+			label += "\n" + n.Type
+		}
+		if len(n.Listen) > 0 {
+			label += "\n" + n.Listen
+		}
+		attrs := "label=" + strconv.Quote(label)
+		switch {
+		case len(n.Listen) > 0:
+			attrs += ", shape=box"
+		case n.Unused:
+			attrs += ", style=dashed"
+		}
+		fmt.Fprintf(b, "  %s [%s];\n", strconv.Quote(n.Tag), attrs)
+	}
+	for _, e := range g.Edges {
+		attrs := ""
+		if c := inCycle[e.From]; c > 0 && c == inCycle[e.To] {
+			attrs = " [color=red]"
+		}
+		fmt.Fprintf(b, "  %s -> %s%s;\n", strconv.Quote(e.From), strconv.Quote(e.To), attrs)
+	}
+	b.WriteString("}\n")
+	return b.Flush()
+}
+
+// WriteJSON writes g in json format.
+func (g *PluginGraph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
+
+// BuildGraph builds plugins from the config file in dry run mode
+// and returns their graph. See CheckConfig.
+func BuildGraph(file string) (*PluginGraph, []error) {
+	m, errs := newDryRunMosdns(file)
+	if m == nil {
+		return nil, errs
+	}
+	defer m.closePluginsExcept(nil)
+	return m.Graph(), errs
+}
+
+// serveGraph serves the graph of current plugins.
+// The format can be "json" (default) or "dot".
+func (m *Mosdns) serveGraph(w http.ResponseWriter, req *http.Request) {
+	if !m.sh.loaded.Load() {
+		http.Error(w, "loading plugins", http.StatusServiceUnavailable)
+		return
+	}
+	g := m.Current().Graph()
+	switch f := req.URL.Query().Get("format"); f {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = g.WriteJSON(w)
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		_ = g.WriteDOT(w)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %s", f), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func Test_findCycles(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []string
+		deps  map[string][]string
+		want  [][]string
+	}{
+		{"no cycle", []string{"a", "b", "c"}, map[string][]string{"b": {"a"}, "c": {"a", "b"}}, nil},
+		{"self loop", []string{"a", "b"}, map[string][]string{"a": {"a"}, "b": {"a"}}, [][]string{{"a"}}},
+		{"cycle", []string{"a", "b", "c", "d"}, map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}, "d": {"a"}}, [][]string{{"a", "b", "c"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := findCycles(tt.nodes, tt.deps)
+			for _, c := range got {
+				slices.Sort(c)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findCycles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
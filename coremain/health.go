@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// HealthReporter is an optional interface for plugins to report their status.
+// e.g. forward reports whether its upstreams are reachable, servers report
+// whether their listeners are bound.
+type HealthReporter interface {
+	// Health returns a non-nil error if the plugin is not able to serve
+	// queries. It will be called by the /health/ready api, so it must
+	// be fast and must not block.
+	Health() error
+}
+
+// HealthStatus is the response of the /health/ready api.
+type HealthStatus struct {
+	Ready   bool                    `json:"ready"`
+	Reason  string                  `json:"reason,omitempty"`
+	Plugins map[string]PluginHealth `json:"plugins,omitempty"`
+}
+
+type PluginHealth struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Health returns the status of m and its plugins that implement HealthReporter.
+// m is ready if all plugins are loaded and healthy, and m is not shutting down.
+func (m *Mosdns) Health() HealthStatus {
+	s := HealthStatus{Ready: true}
+	if m.sh.loaded.Load() {
+		s.Plugins = make(map[string]PluginHealth)
+		for _, tag := range m.order {
+			hr, ok := m.plugins[tag].(HealthReporter)
+			if !ok {
+				continue
+			}
+			if err := hr.Health(); err != nil {
+				s.Plugins[tag] = PluginHealth{Error: err.Error()}
+				s.Ready = false
+				s.Reason = "plugin is unhealthy"
+			} else {
+				s.Plugins[tag] = PluginHealth{Healthy: true}
+			}
+		}
+	} else {
+		// Plugins are being loaded. Don't touch them.
+		s.Ready = false
+		s.Reason = "loading plugins"
+	}
+
+	select {
+	case <-m.sh.sc.ReceiveCloseSignal():
+		s.Ready = false
+		s.Reason = "shutting down"
+	default:
+	}
+	return s
+}
+
+// serveLive always responds 200 as long as the api server is running.
+func (m *Mosdns) serveLive(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// serveReady responds 200 if current plugins are ready, otherwise 503.
+// The body is a json HealthStatus.
+func (m *Mosdns) serveReady(w http.ResponseWriter, _ *http.Request) {
+	s := m.Current().Health()
+	w.Header().Set("Content-Type", "application/json")
+	if !s.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(s)
+}
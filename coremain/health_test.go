@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// apiPoller polls apis while plugins are being loaded.
+type apiPoller struct {
+	addr string
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	notReady []HealthStatus // responses of /health/ready that were not ready.
+	codes    map[string][]int
+}
+
+type apiPollerArgs struct {
+	Poller *apiPoller `yaml:"-"`
+}
+
+func init() {
+	RegNewPluginFunc("_api_poll_test", func(bp *BP, args any) (any, error) {
+		p := args.(*apiPollerArgs).Poller
+		started := make(chan struct{})
+		p.wg.Add(1)
+		go p.run(started)
+		select {
+		case <-started:
+		case <-time.After(time.Second * 5):
+			return nil, fmt.Errorf("api server is not started")
+		}
+		return struct{}{}, nil
+	}, func() any { return new(apiPollerArgs) })
+}
+
+func (p *apiPoller) run(started chan struct{}) {
+	defer p.wg.Done()
+	c := &http.Client{Timeout: time.Second}
+	once := sync.Once{}
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		for _, path := range []string{"/health/ready", "/graph", "/plugins/p1/", "/nonexistent"} {
+			resp, err := c.Get("http://" + p.addr + path)
+			if err != nil {
+				time.Sleep(time.Millisecond)
+				continue
+			}
+			p.mu.Lock()
+			p.codes[path] = append(p.codes[path], resp.StatusCode)
+			if path == "/health/ready" && resp.StatusCode != http.StatusOK {
+				var s HealthStatus
+				_ = json.NewDecoder(resp.Body).Decode(&s)
+				p.notReady = append(p.notReady, s)
+			}
+			p.mu.Unlock()
+			_ = resp.Body.Close()
+		}
+		p.mu.Lock()
+		polled := len(p.codes["/health/ready"]) > 0 && len(p.codes["/nonexistent"]) > 0
+		p.mu.Unlock()
+		if polled {
+			// Polled all apis once. Let other plugins load.
+			once.Do(func() { close(started) })
+		}
+	}
+}
+
+// Apis must be safe to call while plugins are being loaded.
+func TestMosdns_apiWhileLoading(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	p := &apiPoller{addr: addr, stop: make(chan struct{}), codes: make(map[string][]int)}
+	cfg := &Config{API: APIConfig{HTTP: addr}}
+	cfg.Plugins = append(cfg.Plugins, PluginConfig{Tag: "poller", Type: "_api_poll_test", Args: &apiPollerArgs{Poller: p}})
+	for i := 0; i < 200; i++ {
+		cfg.Plugins = append(cfg.Plugins, refPlugin(fmt.Sprintf("p%d", i)))
+	}
+
+	m, err := NewMosdns(cfg)
+	close(p.stop)
+	p.wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.sh.sc.SendCloseSignal(nil)
+	_ = m.sh.sc.WaitClosed()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.notReady) == 0 {
+		t.Fatalf("no response while loading plugins, %v", p.codes)
+	}
+	if s := p.notReady[0]; s.Ready || s.Reason != "loading plugins" || len(s.Plugins) != 0 {
+		t.Fatalf("unexpected status while loading plugins: %+v", s)
+	}
+	if c := p.codes["/graph"][0]; c != http.StatusServiceUnavailable {
+		t.Fatalf("/graph status = %d, want 503", c)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expandConfigValue expands variables in all strings in v, which is
+// a value from the config file. path is the path of v in the config and
+// is used in errors. See expandVars.
+func expandConfigValue(v any, path string) (any, error) {
+	switch v := v.(type) {
+	case string:
+		s, err := expandVars(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return s, nil
+	case map[string]any:
+		for k, e := range v {
+			ne, err := expandConfigValue(e, path+"."+k)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ne
+		}
+		return v, nil
+	case map[any]any:
+		for k, e := range v {
+			ne, err := expandConfigValue(e, fmt.Sprintf("%s.%v", path, k))
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ne
+		}
+		return v, nil
+	case []any:
+		for i, e := range v {
+			ne, err := expandConfigValue(e, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = ne
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// expandVars expands variables in s.
+//
+//	${NAME}           value of environment variable NAME. It is an error
+//	                  if NAME is not set.
+//	${NAME:-default}  value of NAME, or default if NAME is unset or empty.
+//	${file:/path}     content of the file, without trailing newlines.
+//	$${               a literal "${".
+func expandVars(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	b := new(strings.Builder)
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' { // escaped
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		s = s[i+2:]
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable ${%s", s)
+		}
+		v, err := resolveVar(s[:end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+		s = s[end+1:]
+	}
+}
+
+func resolveVar(expr string) (string, error) {
+	if p, ok := strings.CutPrefix(expr, "file:"); ok {
+		if len(p) == 0 {
+			return "", fmt.Errorf("empty file path in ${%s}", expr)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("failed to read ${%s}, %w", expr, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	name, def, hasDef := strings.Cut(expr, ":-")
+	if !validVarName(name) {
+		return "", fmt.Errorf("invalid variable name in ${%s}", expr)
+	}
+	v, ok := os.LookupEnv(name)
+	if hasDef && len(v) == 0 {
+		return def, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set and has no default", name)
+	}
+	return v, nil
+}
+
+func validVarName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
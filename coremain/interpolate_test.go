@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_expandVars(t *testing.T) {
+	t.Setenv("MOSDNS_TEST_VAR", "v")
+	t.Setenv("MOSDNS_TEST_EMPTY", "")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "no var", want: "no var"},
+		{in: "${MOSDNS_TEST_VAR}", want: "v"},
+		{in: "a${MOSDNS_TEST_VAR}b${MOSDNS_TEST_VAR}", want: "avbv"},
+		{in: "${MOSDNS_TEST_UNSET:-d}", want: "d"},
+		{in: "${MOSDNS_TEST_EMPTY:-d}", want: "d"},
+		{in: "${MOSDNS_TEST_VAR:-d}", want: "v"},
+		{in: "${MOSDNS_TEST_EMPTY}", want: ""},
+		{in: "https://dns/?t=${file:" + secret + "}", want: "https://dns/?t=s3cret"},
+		{in: "$${MOSDNS_TEST_VAR}", want: "${MOSDNS_TEST_VAR}"},
+		{in: "${MOSDNS_TEST_UNSET}", wantErr: true},
+		{in: "${MOSDNS_TEST_VAR", wantErr: true},
+		{in: "${1BAD}", wantErr: true},
+		{in: "${file:" + secret + ".not_exist}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := expandVars(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandVars() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expandVars() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
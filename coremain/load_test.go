@@ -0,0 +1,244 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+)
+
+type refTestArgs struct {
+	Refs []string `yaml:"refs"`
+}
+
+func init() {
+	RegNewPluginFunc("_ref_test", func(bp *BP, args any) (any, error) {
+		for _, tag := range args.(*refTestArgs).Refs {
+			if bp.M().GetPlugin(tag) == nil {
+				return nil, fmt.Errorf("can not find %s", tag)
+			}
+		}
+		return struct{}{}, nil
+	}, func() any { return new(refTestArgs) })
+}
+
+func refPlugin(tag string, refs ...string) PluginConfig {
+	return PluginConfig{Tag: tag, Type: "_ref_test", Args: &refTestArgs{Refs: refs}}
+}
+
+func Test_loadPluginsFromCfg(t *testing.T) {
+	tests := []struct {
+		name      string
+		plugins   []PluginConfig
+		wantOrder []string
+		wantErr   string
+	}{
+		{
+			name:      "forward reference",
+			plugins:   []PluginConfig{refPlugin("a", "c"), refPlugin("b"), refPlugin("c", "b")},
+			wantOrder: []string{"b", "c", "a"},
+		},
+		{
+			name:    "cycle",
+			plugins: []PluginConfig{refPlugin("a", "b"), refPlugin("b", "c"), refPlugin("c", "a")},
+			wantErr: "plugin reference cycle: a -> b -> c -> a",
+		},
+		{
+			name:    "self reference",
+			plugins: []PluginConfig{refPlugin("a", "a")},
+			wantErr: "plugin reference cycle: a -> a",
+		},
+		{
+			name:    "missing",
+			plugins: []PluginConfig{refPlugin("a", "b")},
+			wantErr: "can not find b",
+		},
+		{
+			name:    "duplicated",
+			plugins: []PluginConfig{refPlugin("a"), refPlugin("a")},
+			wantErr: "duplicated plugin tag a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMosdns(mlog.Nop(), &shared{})
+			err := m.loadPluginsFromCfg(&Config{Plugins: tt.plugins}, "")
+			if len(tt.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadPluginsFromCfg() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.order, tt.wantOrder) {
+				t.Errorf("loading order = %v, want %v", m.order, tt.wantOrder)
+			}
+		})
+	}
+}
+
+// loadTestFiles writes files to a temp dir, then loads plugins from
+// the file "config.yaml" there.
+func loadTestFiles(t *testing.T, files map[string]string) (*Mosdns, error) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, s := range files {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte(strings.ReplaceAll(s, "$DIR", dir)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg, file, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMosdns(mlog.Nop(), &shared{})
+	return m, m.loadPluginsFromCfg(cfg, file)
+}
+
+func Test_loadPluginsFromCfg_include(t *testing.T) {
+	t.Run("glob order", func(t *testing.T) {
+		m, err := loadTestFiles(t, map[string]string{
+			"config.yaml": `
+include: ["$DIR/conf.d/*.yaml"]
+plugins:
+  - {tag: main, type: _ref_test}
+`,
+			"conf.d/b.yaml":   `plugins: [{tag: b, type: _ref_test}]`,
+			"conf.d/a.yaml":   `plugins: [{tag: a, type: _ref_test}]`,
+			"conf.d/10.yaml":  `plugins: [{tag: "10", type: _ref_test}]`,
+			"conf.d/c.yml":    `plugins: [{tag: c, type: _ref_test}]`,
+			"conf.d/d.yaml.d": `plugins: [{tag: d, type: _ref_test}]`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10", "a", "b", "main"}; !reflect.DeepEqual(m.order, want) {
+			t.Fatalf("loading order = %v, want %v", m.order, want)
+		}
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		// Both namespaces have a "main" that refers to "up". "x.main"
+		// gets its own "x.up". "y" has no "up", so "y.main" gets the
+		// top level one.
+		m, err := loadTestFiles(t, map[string]string{
+			"config.yaml": `
+include:
+  - {path: "$DIR/x.yaml", namespace: x}
+  - {path: "$DIR/y.yaml", namespace: y}
+plugins:
+  - {tag: up, type: _ref_test}
+  - {tag: top, type: _ref_test, args: {refs: [x.main, y.main, x.sub.leaf]}}
+`,
+			"x.yaml": `
+include: [{path: "$DIR/sub.yaml", namespace: sub}]
+plugins:
+  - {tag: main, type: _ref_test, args: {refs: [up, sub.leaf]}}
+  - {tag: up, type: _ref_test}
+`,
+			"y.yaml":   `plugins: [{tag: main, type: _ref_test, args: {refs: [up]}}]`,
+			"sub.yaml": `plugins: [{tag: leaf, type: _ref_test, args: {refs: [up]}}]`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantDeps := map[string][]string{
+			"x.main":     {"x.up", "x.sub.leaf"},
+			"x.sub.leaf": {"x.up"},
+			"y.main":     {"up"},
+			"top":        {"x.main", "y.main", "x.sub.leaf"},
+		}
+		for tag, want := range wantDeps {
+			if got := m.deps[tag]; !reflect.DeepEqual(got, want) {
+				t.Errorf("deps of %s = %v, want %v", tag, got, want)
+			}
+		}
+	})
+
+	for _, tt := range []struct {
+		name  string
+		files map[string]string
+	}{
+		{
+			name: "same namespace",
+			files: map[string]string{
+				"config.yaml": `
+include:
+  - {path: "$DIR/a.yaml", namespace: x}
+  - {path: "$DIR/b.yaml", namespace: x}
+`,
+				"a.yaml": `plugins: [{tag: main, type: _ref_test}]`,
+				"b.yaml": `plugins: [{tag: main, type: _ref_test}]`,
+			},
+		},
+		{
+			name: "namespaced and top level",
+			files: map[string]string{
+				"config.yaml": `
+include: [{path: "$DIR/a.yaml", namespace: x}]
+plugins: [{tag: x.main, type: _ref_test}]
+`,
+				"a.yaml": `plugins: [{tag: main, type: _ref_test}]`,
+			},
+		},
+		{
+			name: "nested and joined",
+			files: map[string]string{
+				"config.yaml": `
+include:
+  - {path: "$DIR/a.yaml", namespace: x}
+  - {path: "$DIR/b.yaml", namespace: x}
+`,
+				"a.yaml": `include: [{path: "$DIR/c.yaml", namespace: y}]`,
+				"b.yaml": `plugins: [{tag: y.main, type: _ref_test}]`,
+				"c.yaml": `plugins: [{tag: main, type: _ref_test}]`,
+			},
+		},
+	} {
+		t.Run("collision "+tt.name, func(t *testing.T) {
+			_, err := loadTestFiles(t, tt.files)
+			if err == nil || !strings.Contains(err.Error(), "duplicated plugin tag x.") {
+				t.Fatalf("want duplicated tag error, got %v", err)
+			}
+		})
+	}
+
+	t.Run("invalid namespace", func(t *testing.T) {
+		_, err := loadTestFiles(t, map[string]string{
+			"config.yaml": `include: [{path: "$DIR/a.yaml", namespace: x.y}]`,
+			"a.yaml":      `plugins: [{tag: main, type: _ref_test}]`,
+		})
+		if err == nil {
+			t.Fatal("namespace with '.' should be invalid")
+		}
+	})
+}
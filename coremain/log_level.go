@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type logLevelPayload struct {
+	Level zapcore.Level `json:"level"`
+}
+
+// logLevelApi registers log level apis:
+//
+//	GET|PUT /        get or set the global level, e.g. {"level":"debug"}
+//	GET /plugins     get all per-plugin levels.
+//	PUT /plugins/{tag}     set the level of a plugin, e.g. {"level":"debug"}
+//	DELETE /plugins/{tag}  the plugin uses the global level again.
+func (m *Mosdns) logLevelApi(r chi.Router) {
+	lv := m.sh.logLevels
+	global := lv.Global()
+	r.Method(http.MethodGet, "/", global)
+	r.Method(http.MethodPut, "/", global)
+
+	r.Get("/plugins", func(w http.ResponseWriter, req *http.Request) {
+		levels := make(map[string]string)
+		for tag, l := range lv.Overrides() {
+			levels[tag] = l.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(levels)
+	})
+	r.Put("/plugins/{tag}", func(w http.ResponseWriter, req *http.Request) {
+		tag := chi.URLParam(req, "tag")
+		var p logLevelPayload
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid level, %s", err), http.StatusBadRequest)
+			return
+		}
+		lv.SetOverride(tag, p.Level)
+		m.logger.Info("plugin log level changed", zap.String("tag", tag), zap.Stringer("level", p.Level))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p)
+	})
+	r.Delete("/plugins/{tag}", func(w http.ResponseWriter, req *http.Request) {
+		tag := chi.URLParam(req, "tag")
+		lv.DeleteOverride(tag)
+		m.logger.Info("plugin log level override removed", zap.String("tag", tag))
+		w.WriteHeader(http.StatusOK)
+	})
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// logTestPlugin keeps the logger of its plugin.
+type logTestPlugin struct {
+	l *zap.Logger
+}
+
+func init() {
+	RegNewPluginFunc("_log_test", func(bp *BP, _ any) (any, error) {
+		return &logTestPlugin{l: bp.L()}, nil
+	}, func() any { return new(struct{}) })
+}
+
+func TestMosdns_logLevelApi(t *testing.T) {
+	dir := t.TempDir()
+	apiAddr := freeTCPAddr(t)
+	logFile := filepath.Join(dir, "mosdns.log")
+	file := filepath.Join(dir, "config.yaml")
+	cfg := fmt.Sprintf(`
+log: {level: info, file: "%s"}
+api: {http: "%s"}
+plugins:
+  - {tag: p1, type: _log_test}
+  - {tag: p2, type: _log_test}
+`, logFile, apiAddr)
+	if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewTestMosdnsFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+
+	waitAPI(t, apiAddr)
+
+	do := func(method, path, body string) string {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://"+apiAddr+"/log/level"+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s: status %d, %s", method, path, resp.StatusCode, b)
+		}
+		return string(b)
+	}
+	// logDebug logs a debug message with each plugin logger and returns
+	// the messages that were written.
+	round := 0
+	logDebug := func() (logged []string) {
+		t.Helper()
+		round++
+		for _, tag := range []string{"p1", "p2"} {
+			m.GetPlugin(tag).(*logTestPlugin).l.Debug(fmt.Sprintf("debug %s %d", tag, round))
+		}
+		b, err := os.ReadFile(logFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range []string{"p1", "p2"} {
+			if strings.Contains(string(b), fmt.Sprintf("debug %s %d", tag, round)) {
+				logged = append(logged, tag)
+			}
+		}
+		return logged
+	}
+
+	if logged := logDebug(); len(logged) != 0 {
+		t.Fatalf("debug logs are written before level change, %v", logged)
+	}
+
+	do(http.MethodPut, "/plugins/p1", `{"level":"debug"}`)
+	if logged := logDebug(); len(logged) != 1 || logged[0] != "p1" {
+		t.Fatalf("want debug logs from p1 only, got %v", logged)
+	}
+	var levels map[string]string
+	if err := json.Unmarshal([]byte(do(http.MethodGet, "/plugins", "")), &levels); err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 1 || levels["p1"] != "debug" {
+		t.Fatalf("unexpected plugin levels %v", levels)
+	}
+
+	do(http.MethodDelete, "/plugins/p1", "")
+	if logged := logDebug(); len(logged) != 0 {
+		t.Fatalf("override was not removed, got debug logs from %v", logged)
+	}
+}
@@ -29,58 +29,146 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"go.uber.org/zap"
-	"io"
 	"net/http"
 	"net/http/pprof"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Mosdns is a set of plugins and the runtime they share.
+// A reload creates a new Mosdns that shares the runtime (logger, api, metrics
+// registry, SafeClose) with the old one. See Reload.
 type Mosdns struct {
 	logger *zap.Logger // non-nil logger.
 
 	// Plugins
-	plugins map[string]any
+	plugins    map[string]any
+	pluginCfgs map[string]PluginConfig
+	reused     map[string]struct{}       // tags of plugins that were taken over from prev.
+	prev       *Mosdns                   // the Mosdns being replaced, only set during loading.
+	order      []string                  // plugin tags in loading order.
+	loading    string                    // tag of the plugin being initialized.
+	loadingNS  string                    // namespace of the plugin being initialized.
+	loadStack  []string                  // tags of plugins being initialized, outermost first.
+	pending    map[string]*pendingPlugin // tagged plugins that are declared but not initialized yet.
+	loadErrs   []error                   // errors of plugins that were initialized by GetPlugin.
+	deps       map[string][]string       // plugins that each plugin got by GetPlugin during its init.
 
+	pluginMux  *chi.Mux             // plugin api, mounted at /plugins.
+	metricsReg *prometheus.Registry // plugin metrics.
+
+	// number of queries that are being handled by plugins of this Mosdns.
+	inflight atomic.Int64
+
+	dryRun    bool
+	checkErrs []error // errors found in dry run mode, see CheckConfig.
+
+	sh *shared
+}
+
+// shared contains things that are shared by all Mosdns created from the same
+// NewMosdns call.
+type shared struct {
 	httpMux    *chi.Mux
-	metricsReg *prometheus.Registry
+	metricsReg *prometheus.Registry // process and go metrics.
 	sc         *safe_close.SafeClose
+
+	cfgFile      string        // the file that Reload reads config from.
+	drainTimeout time.Duration // protected by reloadMu.
+	logLevels    *mlog.Levels  // levels of the logger, nil if the logger is not from config.
+
+	reloadMu sync.Mutex
+	closed   bool // sc was closed, protected by reloadMu.
+	cur      atomic.Pointer[Mosdns]
+
+	loaded atomic.Bool // plugins from the config were loaded.
 }
 
 // NewMosdns initializes a mosdns instance and its plugins.
 func NewMosdns(cfg *Config) (*Mosdns, error) {
 	// Init logger.
-	lg, err := mlog.NewLogger(cfg.Log)
+	lg, logLevels, err := mlog.NewLoggerWithLevels(cfg.Log)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init logger: %w", err)
 	}
 
-	m := &Mosdns{
-		logger:     lg,
-		plugins:    make(map[string]any),
+	apiAuth, err := newAPIAuth(&cfg.API)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api config: %w", err)
+	}
+	apiTLSConfig, err := newAPITLSConfig(&cfg.API)
+	if err != nil {
+		return nil, fmt.Errorf("invalid api config: %w", err)
+	}
+
+	sh := &shared{
 		httpMux:    chi.NewRouter(),
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
+		logLevels:  logLevels,
+
+		drainTimeout: drainTimeout(cfg),
 	}
-	// This must be called after m.httpMux and m.metricsReg been set.
+	m := newMosdns(lg, sh)
+	sh.cur.Store(m)
+	// This must be called after sh.httpMux and sh.metricsReg been set.
 	m.initHttpMux()
 
+	// Closed once all plugins are closed on shutdown.
+	pluginsClosed := make(chan struct{})
+
+	// Close all plugins on signal.
+	// From here, call m.sc.SendCloseSignal() if any plugin failed to load.
+	sh.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		go func() {
+			defer done()
+			<-closeSignal
+			m.logger.Info("starting shutdown sequences")
+			sh.reloadMu.Lock()
+			sh.closed = true
+			cur := sh.cur.Load()
+			timeout := sh.drainTimeout
+			sh.reloadMu.Unlock()
+			cur.shutdown(timeout)
+			m.logger.Info("all plugins were closed")
+			close(pluginsClosed)
+		}()
+	})
+
 	// Start http api server
 	if httpAddr := cfg.API.HTTP; len(httpAddr) > 0 {
+		var h http.Handler = sh.httpMux
+		if apiAuth != nil {
+			h = apiAuth.Handler(h)
+		}
 		httpServer := &http.Server{
-			Addr:    httpAddr,
-			Handler: m.httpMux,
+			Addr:      httpAddr,
+			Handler:   h,
+			TLSConfig: apiTLSConfig,
 		}
-		m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		sh.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
 			defer done()
 			errChan := make(chan error, 1)
 			go func() {
-				m.logger.Info("starting api http server", zap.String("addr", httpAddr))
-				errChan <- httpServer.ListenAndServe()
+				m.logger.Info("starting api http server", zap.String("addr", httpAddr), zap.Bool("tls", apiTLSConfig != nil))
+				if apiTLSConfig != nil {
+					errChan <- httpServer.ListenAndServeTLS("", "") // certs are in TLSConfig.
+				} else {
+					errChan <- httpServer.ListenAndServe()
+				}
 			}()
 			select {
 			case err := <-errChan:
-				m.sc.SendCloseSignal(err)
+				sh.sc.SendCloseSignal(err)
 			case <-closeSignal:
+				// Keep serving (e.g. /health/ready reports not ready) until
+				// plugins are closed.
+				<-pluginsClosed
 				_ = httpServer.Close()
 			}
 		})
@@ -88,58 +176,80 @@ func NewMosdns(cfg *Config) (*Mosdns, error) {
 
 	// Load plugins.
 
-	// Close all plugins on signal.
-	// From here, call m.sc.SendCloseSignal() if any plugin failed to load.
-	m.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
-		go func() {
-			defer done()
-			<-closeSignal
-			m.logger.Info("starting shutdown sequences")
-			for tag, p := range m.plugins {
-				if closer, _ := p.(io.Closer); closer != nil {
-					m.logger.Info("closing plugin", zap.String("tag", tag))
-					_ = closer.Close()
-				}
-			}
-			m.logger.Info("all plugins were closed")
-		}()
-	})
-
 	// Preset plugins
 	if err := m.loadPresetPlugins(); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
+		sh.sc.SendCloseSignal(err)
+		_ = sh.sc.WaitClosed()
 		return nil, err
 	}
 	// Plugins from config.
-	if err := m.loadPluginsFromCfg(cfg, 0); err != nil {
-		m.sc.SendCloseSignal(err)
-		_ = m.sc.WaitClosed()
+	if err := m.loadPluginsFromCfg(cfg, ""); err != nil {
+		sh.sc.SendCloseSignal(err)
+		_ = sh.sc.WaitClosed()
 		return nil, err
 	}
 	m.logger.Info("all plugins are loaded")
+	sh.loaded.Store(true)
 
 	return m, nil
 }
 
+func newMosdns(lg *zap.Logger, sh *shared) *Mosdns {
+	m := &Mosdns{
+		logger:     lg,
+		plugins:    make(map[string]any),
+		pluginCfgs: make(map[string]PluginConfig),
+		reused:     make(map[string]struct{}),
+		deps:       make(map[string][]string),
+		pluginMux:  chi.NewRouter(),
+		metricsReg: prometheus.NewRegistry(),
+		sh:         sh,
+	}
+	m.pluginMux.NotFound(m.invalidApiReqHelper)
+	m.pluginMux.MethodNotAllowed(m.invalidApiReqHelper)
+	return m
+}
+
+// NewTestMosdnsFromFile returns a mosdns instance from the config file
+// for testing. Unlike NewMosdns, it can be reloaded.
+// Call GetSafeClose().SendCloseSignal() to shut it down.
+func NewTestMosdnsFromFile(file string) (*Mosdns, error) {
+	cfg, fileUsed, err := loadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewMosdns(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.sh.cfgFile = fileUsed
+	return m, nil
+}
+
 // NewTestMosdnsWithPlugins returns a mosdns instance for testing.
 func NewTestMosdnsWithPlugins(p map[string]any) *Mosdns {
-	return &Mosdns{
-		logger:     mlog.Nop(),
+	sh := &shared{
 		httpMux:    chi.NewRouter(),
-		plugins:    p,
 		metricsReg: newMetricsReg(),
 		sc:         safe_close.NewSafeClose(),
 	}
+	m := newMosdns(mlog.Nop(), sh)
+	m.plugins = p
+	for tag := range p {
+		m.order = append(m.order, tag)
+	}
+	sh.cur.Store(m)
+	sh.loaded.Store(true)
+	return m
 }
 
 func (m *Mosdns) GetSafeClose() *safe_close.SafeClose {
-	return m.sc
+	return m.sh.sc
 }
 
 // CloseWithErr is a shortcut for m.sc.SendCloseSignal
 func (m *Mosdns) CloseWithErr(err error) {
-	m.sc.SendCloseSignal(err)
+	m.sh.sc.SendCloseSignal(err)
 }
 
 // Logger returns a non-nil logger.
@@ -148,8 +258,27 @@ func (m *Mosdns) Logger() *zap.Logger {
 }
 
 // GetPlugin returns a plugin.
+// If it is called during the init of another plugin, the reference
+// will be recorded in the plugin graph. See Graph. And if the plugin
+// is declared but not initialized yet, it will be initialized now. If
+// the plugin references the plugin being initialized, directly or not,
+// it is a reference cycle and nil is returned.
+// The tag is resolved by ResolveTag.
 func (m *Mosdns) GetPlugin(tag string) any {
-	return m.plugins[tag]
+	tag = m.ResolveTag(tag)
+	if pp, ok := m.pending[tag]; ok {
+		if err := m.loadPending(pp); err != nil {
+			m.loadErrs = append(m.loadErrs, err)
+		}
+	} else if i := slices.Index(m.loadStack, tag); i >= 0 {
+		path := append(slices.Clone(m.loadStack[i:]), tag)
+		m.loadErrs = append(m.loadErrs, fmt.Errorf("plugin reference cycle: %s", strings.Join(path, " -> ")))
+	}
+	p := m.plugins[tag]
+	if p != nil && len(m.loading) > 0 {
+		m.addDep(m.loading, tag)
+	}
+	return p
 }
 
 // GetMetricsReg returns a prometheus.Registerer with a prefix of "mosdns_"
@@ -158,11 +287,11 @@ func (m *Mosdns) GetMetricsReg() prometheus.Registerer {
 }
 
 func (m *Mosdns) GetAPIRouter() *chi.Mux {
-	return m.httpMux
+	return m.sh.httpMux
 }
 
 func (m *Mosdns) RegPluginAPI(tag string, mux *chi.Mux) {
-	m.httpMux.Mount("/plugins/"+tag, mux)
+	m.pluginMux.Mount("/"+tag, mux)
 }
 
 func newMetricsReg() *prometheus.Registry {
@@ -172,13 +301,19 @@ func newMetricsReg() *prometheus.Registry {
 	return reg
 }
 
-// initHttpMux initializes api entries. It MUST be called after m.metricsReg being initialized.
+// initHttpMux initializes api entries. It MUST be called after m.sh being initialized.
 func (m *Mosdns) initHttpMux() {
+	sh := m.sh
+	mux := sh.httpMux
+
 	// Register metrics.
-	m.httpMux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(m.metricsReg, promhttp.HandlerOpts{}))
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		return prometheus.Gatherers{sh.metricsReg, m.Current().metricsReg}.Gather()
+	})
+	mux.Method(http.MethodGet, "/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
 
 	// Register pprof.
-	m.httpMux.Route("/debug/pprof", func(r chi.Router) {
+	mux.Route("/debug/pprof", func(r chi.Router) {
 		r.Get("/*", pprof.Index)
 		r.Get("/cmdline", pprof.Cmdline)
 		r.Get("/profile", pprof.Profile)
@@ -186,37 +321,143 @@ func (m *Mosdns) initHttpMux() {
 		r.Get("/trace", pprof.Trace)
 	})
 
-	// A helper page for invalid request.
-	invalidApiReqHelper := func(w http.ResponseWriter, req *http.Request) {
-		b := new(bytes.Buffer)
-		_, _ = fmt.Fprintf(b, "Invalid request %s %s\n\n", req.Method, req.RequestURI)
-		b.WriteString("Available api urls:\n")
-		_ = chi.Walk(m.httpMux, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+	// Log levels.
+	if sh.logLevels != nil {
+		mux.Route("/log/level", m.logLevelApi)
+	}
+
+	// Health checks.
+	mux.Get("/health/live", m.serveLive)
+	mux.Get("/health/ready", m.serveReady)
+
+	// Plugin graph.
+	mux.Get("/graph", m.serveGraph)
+
+	// Reload.
+	mux.Post("/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := m.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	// Plugin apis are served by the current plugins.
+	mux.Mount("/plugins", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !m.sh.loaded.Load() { // apis are being registered.
+			http.Error(w, "loading plugins", http.StatusServiceUnavailable)
+			return
+		}
+		m.Current().pluginMux.ServeHTTP(w, req)
+	}))
+
+	mux.NotFound(m.invalidApiReqHelper)
+	mux.MethodNotAllowed(m.invalidApiReqHelper)
+}
+
+// invalidApiReqHelper is a helper page for invalid request.
+func (m *Mosdns) invalidApiReqHelper(w http.ResponseWriter, req *http.Request) {
+	b := new(bytes.Buffer)
+	_, _ = fmt.Fprintf(b, "Invalid request %s %s\n\n", req.Method, req.RequestURI)
+	b.WriteString("Available api urls:\n")
+	walk := func(prefix string, r chi.Routes) {
+		_ = chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+			if prefix == "" && strings.HasPrefix(route, "/plugins") { // walked below
+				return nil
+			}
 			b.WriteString(method)
 			b.WriteByte(' ')
+			b.WriteString(prefix)
 			b.WriteString(route)
 			b.WriteByte('\n')
 			return nil
 		})
-		_, _ = w.Write(b.Bytes())
 	}
-	m.httpMux.NotFound(invalidApiReqHelper)
-	m.httpMux.MethodNotAllowed(invalidApiReqHelper)
+	walk("", m.sh.httpMux)
+	if m.sh.loaded.Load() {
+		walk("/plugins", m.Current().pluginMux)
+	}
+	_, _ = w.Write(b.Bytes())
 }
 
 func (m *Mosdns) loadPresetPlugins() error {
 	for tag, f := range LoadNewPersetPluginFuncs() {
+		m.loading = tag
 		p, err := f(NewBP(tag, m))
+		m.loading = ""
 		if err != nil {
 			return fmt.Errorf("failed to init preset plugin %s, %w", tag, err)
 		}
-		m.plugins[tag] = p
+		m.addPlugin(tag, p)
 	}
 	return nil
 }
 
-// loadPluginsFromCfg loads plugins from this config. It follows include first.
-func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
+// pendingPlugin is a plugin config that was collected but has not been
+// initialized yet.
+type pendingPlugin struct {
+	cfg  PluginConfig // cfg.Tag is the full tag, with namespace.
+	file string       // file that cfg was loaded from.
+	ns   string
+	i    int // index in the file.
+}
+
+// loadPluginsFromCfg loads plugins from this config and its includes.
+// file is the file that cfg was loaded from, it can be empty.
+// All plugin configs are collected first. Then plugins are initialized in
+// config order, except that a plugin referenced by GetPlugin during the
+// init of another plugin is initialized first. So plugins can reference
+// plugins that are declared after them. See GetPlugin.
+// In dry run mode, errors are collected into m.checkErrs and loading continues.
+func (m *Mosdns) loadPluginsFromCfg(cfg *Config, file string) error {
+	var ps []*pendingPlugin
+	if err := m.collectPlugins(cfg, file, "", 0, &ps); err != nil {
+		return err
+	}
+
+	m.pending = make(map[string]*pendingPlugin)
+	defer func() { m.pending = nil }()
+	for _, p := range ps {
+		tag := p.cfg.Tag
+		if len(tag) == 0 {
+			continue
+		}
+		_, dup := m.pending[tag]
+		if _, ok := m.plugins[tag]; ok || dup {
+			err := withFile(p.file, fmt.Errorf("duplicated plugin tag %s", tag))
+			if m.dryRun {
+				m.checkErrs = append(m.checkErrs, err)
+				continue
+			}
+			return err
+		}
+		m.pending[tag] = p
+	}
+
+	for _, p := range ps {
+		err := m.loadPending(p)
+		// Errors of plugins that were initialized by GetPlugin come first.
+		// They are usually the cause of err.
+		errs := m.loadErrs
+		m.loadErrs = nil
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			continue
+		}
+		if m.dryRun {
+			m.checkErrs = append(m.checkErrs, errs...)
+			continue
+		}
+		return errs[0]
+	}
+	return nil
+}
+
+// collectPlugins appends plugin configs of cfg to ps. It follows include first.
+// ns is the namespace of cfg, tags of its plugins will be prefixed with "ns.".
+func (m *Mosdns) collectPlugins(cfg *Config, file string, ns string, includeDepth int, ps *[]*pendingPlugin) error {
 	const maxIncludeDepth = 8
 	if includeDepth > maxIncludeDepth {
 		return errors.New("maximum include depth reached")
@@ -224,21 +465,103 @@ func (m *Mosdns) loadPluginsFromCfg(cfg *Config, includeDepth int) error {
 	includeDepth++
 
 	// Follow include first.
-	for _, s := range cfg.Include {
-		subCfg, path, err := loadConfig(s)
+	for _, inc := range cfg.Include {
+		if err := m.collectInclude(inc, ns, includeDepth, ps); err != nil {
+			if m.dryRun {
+				m.checkErrs = append(m.checkErrs, withFile(file, err))
+				continue
+			}
+			return err
+		}
+	}
+
+	for i, pc := range cfg.Plugins {
+		if len(ns) > 0 && len(pc.Tag) > 0 {
+			pc.Tag = ns + "." + pc.Tag
+		}
+		*ps = append(*ps, &pendingPlugin{cfg: pc, file: file, ns: ns, i: i})
+	}
+	return nil
+}
+
+// collectInclude collects plugins from files that match inc.
+func (m *Mosdns) collectInclude(inc IncludeConfig, ns string, includeDepth int, ps *[]*pendingPlugin) error {
+	files, err := inc.files()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		m.logger.Warn("no config file matches the include pattern", zap.String("pattern", inc.Path))
+	}
+	subNs := inc.namespace(ns)
+	for _, f := range files {
+		subCfg, path, err := loadConfig(f)
 		if err != nil {
-			return fmt.Errorf("failed to read config from %s, %w", s, err)
+			return fmt.Errorf("failed to read config from %s, %w", f, err)
 		}
-		m.logger.Info("load config", zap.String("file", path))
-		if err := m.loadPluginsFromCfg(subCfg, includeDepth); err != nil {
-			return fmt.Errorf("failed to load config from %s, %w", s, err)
+		m.logger.Info("load config", zap.String("file", path), zap.String("namespace", subNs))
+		if err := m.collectPlugins(subCfg, path, subNs, includeDepth, ps); err != nil {
+			return fmt.Errorf("failed to load config from %s, %w", f, err)
 		}
 	}
+	return nil
+}
 
-	for i, pc := range cfg.Plugins {
-		if err := m.newPlugin(pc); err != nil {
-			return fmt.Errorf("failed to init plugin #%d %s, %w", i, pc.Tag, err)
+// loadPending initializes p if it was not initialized yet.
+func (m *Mosdns) loadPending(p *pendingPlugin) error {
+	if tag := p.cfg.Tag; len(tag) > 0 {
+		if _, ok := m.pending[tag]; !ok { // Already initialized, or failed.
+			return nil
 		}
+		delete(m.pending, tag)
+	}
+
+	prevLoading, prevNS := m.loading, m.loadingNS
+	m.loadStack = append(m.loadStack, p.cfg.Tag)
+	m.loadingNS = p.ns
+	err := m.newPlugin(p.cfg)
+	m.loadStack = m.loadStack[:len(m.loadStack)-1]
+	m.loading, m.loadingNS = prevLoading, prevNS
+	if err != nil {
+		return withFile(p.file, fmt.Errorf("failed to init plugin #%d %s, %w", p.i, p.cfg.Tag, err))
 	}
 	return nil
 }
+
+// hasTag reports whether tag is a loaded plugin or a plugin
+// that will be loaded.
+func (m *Mosdns) hasTag(tag string) bool {
+	if _, ok := m.plugins[tag]; ok {
+		return true
+	}
+	if _, ok := m.pending[tag]; ok {
+		return true
+	}
+	return slices.Contains(m.loadStack, tag)
+}
+
+// ResolveTag returns the full tag of the plugin that tag refers to.
+// When a plugin in a namespace is being initialized, tag is looked up in
+// its namespace first, then in parent namespaces, e.g. "main" in namespace
+// "a.b" can be "a.b.main", "a.main" or "main". Otherwise, tag is returned
+// as it is.
+func (m *Mosdns) ResolveTag(tag string) string {
+	for ns := m.loadingNS; len(ns) > 0; {
+		if t := ns + "." + tag; m.hasTag(t) {
+			return t
+		}
+		i := strings.LastIndexByte(ns, '.')
+		if i < 0 {
+			break
+		}
+		ns = ns[:i]
+	}
+	return tag
+}
+
+func withFile(file string, err error) error {
+	if len(file) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s: %w", file, err)
+}
@@ -25,6 +25,7 @@ import (
 	"github.com/go-chi/chi/v5"
 	"go.uber.org/zap"
 	"reflect"
+	"slices"
 	"sync"
 )
 
@@ -96,6 +97,20 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 		return fmt.Errorf("duplicated plugin tag %s", c.Tag)
 	}
 
+	if p := m.prev.reusablePlugin(c); p != nil {
+		m.logger.Info("reusing plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
+		m.loading = c.Tag
+		err := p.ReuseIn(NewBP(c.Tag, m))
+		m.loading = ""
+		if err != nil {
+			return fmt.Errorf("failed to reuse plugin: %w", err)
+		}
+		m.addPlugin(c.Tag, p)
+		m.pluginCfgs[c.Tag] = c
+		m.reused[c.Tag] = struct{}{}
+		return nil
+	}
+
 	typeInfo, ok := GetPluginType(c.Type)
 	if !ok {
 		return fmt.Errorf("plugin type %s not defined", c.Type)
@@ -111,14 +126,55 @@ func (m *Mosdns) newPlugin(c PluginConfig) error {
 	}
 
 	m.logger.Info("loading plugin", zap.String("tag", c.Tag), zap.String("type", c.Type))
+	m.loading = c.Tag
 	p, err := typeInfo.NewPlugin(NewBP(c.Tag, m), args)
+	m.loading = ""
 	if err != nil {
 		return fmt.Errorf("failed to init plugin: %w", err)
 	}
-	m.plugins[c.Tag] = p
+	m.addPlugin(c.Tag, p)
+	m.pluginCfgs[c.Tag] = c
 	return nil
 }
 
+func (m *Mosdns) addPlugin(tag string, p any) {
+	m.plugins[tag] = p
+	m.order = append(m.order, tag)
+}
+
+// addDep records that plugin from depends on plugin to.
+func (m *Mosdns) addDep(from, to string) {
+	if slices.Contains(m.deps[from], to) {
+		return
+	}
+	m.deps[from] = append(m.deps[from], to)
+}
+
+// ReusablePlugin is a plugin that can be taken over by the new plugins
+// on reload, instead of being closed and initialized again. e.g. a server
+// that keeps its sockets. A plugin is reused only if its tag, type and
+// args in the new config are unchanged.
+type ReusablePlugin interface {
+	// ReuseIn is called when the plugin is taken over by bp.M().
+	// Plugin should register its api and metrics to bp again and check
+	// that the plugins it depends on are still valid.
+	ReuseIn(bp *BP) error
+}
+
+// reusablePlugin returns the plugin in m that can be reused by c.
+// It returns nil if m is nil or there is no such plugin.
+func (m *Mosdns) reusablePlugin(c PluginConfig) ReusablePlugin {
+	if m == nil {
+		return nil
+	}
+	oc, ok := m.pluginCfgs[c.Tag]
+	if !ok || oc.Type != c.Type || !reflect.DeepEqual(oc.Args, c.Args) {
+		return nil
+	}
+	p, _ := m.plugins[c.Tag].(ReusablePlugin)
+	return p
+}
+
 // GetAllPluginTypes returns all plugin types which are configurable.
 func GetAllPluginTypes() []string {
 	pluginTypeRegister.RLock()
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultDrainTimeout is the default maximum time that plugins wait
+	// for their queries before being closed on reload and shutdown.
+	defaultDrainTimeout = time.Second * 10
+	drainCheckInterval  = time.Millisecond * 100
+)
+
+var errClosed = errors.New("mosdns was closed")
+
+// Current returns the Mosdns that is currently serving queries.
+// It may differ from m after a reload.
+func (m *Mosdns) Current() *Mosdns {
+	if cur := m.sh.cur.Load(); cur != nil {
+		return cur
+	}
+	return m
+}
+
+// QueryStarted marks that a query starts to be handled by plugins of m.
+// QueryFinished must be called once the query is done.
+// Replaced plugins are not closed until all their queries are done.
+func (m *Mosdns) QueryStarted() {
+	m.inflight.Add(1)
+}
+
+// QueryFinished marks that a query started by QueryStarted is done.
+func (m *Mosdns) QueryFinished() {
+	m.inflight.Add(-1)
+}
+
+// Reload reads the config file again and replaces current plugins with
+// new plugins from it.
+// New plugins are initialized alongside the current ones. If any of them
+// fails, they will be closed and current plugins keep serving.
+// Otherwise, new plugins take over all new queries, and current plugins
+// will be closed once their queries are done (see Config.DrainTimeout).
+// Plugins that implement ReusablePlugin and whose configs are unchanged
+// are not re-created. e.g. servers keep their sockets.
+// Log and api configs can not be reloaded.
+func (m *Mosdns) Reload() error {
+	sh := m.sh
+	sh.reloadMu.Lock()
+	defer sh.reloadMu.Unlock()
+	if sh.closed {
+		return errClosed
+	}
+	if len(sh.cfgFile) == 0 {
+		return errors.New("mosdns was not started from a config file")
+	}
+
+	cfg, _, err := loadConfig(sh.cfgFile)
+	if err != nil {
+		return fmt.Errorf("failed to load config, %w", err)
+	}
+
+	old := sh.cur.Load()
+	old.logger.Info("reloading", zap.String("file", sh.cfgFile))
+	nm := newMosdns(old.logger, sh)
+	nm.prev = old
+	err = nm.loadPresetPlugins()
+	if err == nil {
+		err = nm.loadPluginsFromCfg(cfg, sh.cfgFile)
+	}
+	nm.prev = nil
+	if err != nil {
+		nm.closePluginsExcept(nm.reused)
+		old.logger.Error("failed to reload, keep using current plugins", zap.Error(err))
+		return err
+	}
+
+	sh.cur.Store(nm)
+	sh.drainTimeout = drainTimeout(cfg)
+	old.logger.Info("reloaded, new plugins are serving")
+	timeout := sh.drainTimeout
+	// Stop accepting right away, so sockets of replaced servers leave
+	// SO_REUSEPORT groups before Reload returns.
+	old.stopAcceptingExcept(nm.reused)
+	sh.sc.Attach(func(done func(), closeSignal <-chan struct{}) {
+		defer done()
+		old.drain(timeout, closeSignal)
+		old.closePluginsExcept(nm.reused)
+		old.logger.Info("replaced plugins were closed")
+	})
+	return nil
+}
+
+// drainTimeout returns the drain timeout from cfg.
+func drainTimeout(cfg *Config) time.Duration {
+	if cfg.DrainTimeout > 0 {
+		return time.Duration(cfg.DrainTimeout) * time.Second
+	}
+	return defaultDrainTimeout
+}
+
+// drain waits until all queries in m are done, abort is closed
+// or timeout is reached. abort can be nil.
+func (m *Mosdns) drain(timeout time.Duration, abort <-chan struct{}) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for m.inflight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			m.logger.Warn("drain timed out", zap.Int64("queries", m.inflight.Load()))
+			return
+		case <-abort:
+			return
+		}
+	}
+}
+
+// closePluginsExcept closes plugins in m except those in skip.
+// Plugins are closed in reverse loading order, so a plugin is closed
+// before the plugins it depends on.
+func (m *Mosdns) closePluginsExcept(skip map[string]struct{}) {
+	for _, tag := range slices.Backward(m.order) {
+		if _, ok := skip[tag]; ok {
+			continue
+		}
+		if closer, _ := m.plugins[tag].(io.Closer); closer != nil {
+			m.logger.Info("closing plugin", zap.String("tag", tag))
+			_ = closer.Close()
+		}
+	}
+}
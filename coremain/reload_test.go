@@ -0,0 +1,200 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type reloadTestArgs struct {
+	Addr string `yaml:"addr"` // listens on it, if set.
+	Ver  int    `yaml:"ver"`
+}
+
+// reloadTestPlugin is a reusable plugin that can listen like a server.
+type reloadTestPlugin struct {
+	l      net.Listener
+	closed atomic.Bool
+}
+
+var _ ReusablePlugin = (*reloadTestPlugin)(nil)
+
+func init() {
+	RegNewPluginFunc("_reload_test", func(bp *BP, args any) (any, error) {
+		p := new(reloadTestPlugin)
+		if addr := args.(*reloadTestArgs).Addr; len(addr) > 0 {
+			l, err := net.Listen("tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			p.l = l
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					_ = c.Close()
+				}
+			}()
+		}
+		return p, nil
+	}, func() any { return new(reloadTestArgs) })
+}
+
+func (p *reloadTestPlugin) ReuseIn(_ *BP) error { return nil }
+
+func (p *reloadTestPlugin) Close() error {
+	p.closed.Store(true)
+	if p.l != nil {
+		return p.l.Close()
+	}
+	return nil
+}
+
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// waitAPI waits until the api server at addr is started.
+func waitAPI(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		resp, err := http.Get("http://" + addr + "/health/live")
+		if err == nil {
+			_ = resp.Body.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("api server is not started, %v", err)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMosdns_reloadApi(t *testing.T) {
+	apiAddr, serverAddr := freeTCPAddr(t), freeTCPAddr(t)
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeCfg := func(otherVer int, bad bool) {
+		cfg := fmt.Sprintf(`
+log: {level: error}
+drain_timeout: 1
+api: {http: "%s"}
+plugins:
+  - {tag: server, type: _reload_test, args: {addr: "%s"}}
+  - {tag: other, type: _reload_test, args: {ver: %d}}
+`, apiAddr, serverAddr, otherVer)
+		if bad {
+			cfg += "  - {tag: bad, type: _ref_test, args: {refs: [missing]}}\n"
+		}
+		if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reload := func() int {
+		t.Helper()
+		resp, err := http.Post("http://"+apiAddr+"/reload", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	dial := func() {
+		t.Helper()
+		c, err := net.DialTimeout("tcp", serverAddr, time.Second)
+		if err != nil {
+			t.Fatalf("listener is down, %v", err)
+		}
+		_ = c.Close()
+	}
+
+	writeCfg(1, false)
+	m, err := NewTestMosdnsFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+	waitAPI(t, apiAddr)
+	server := m.GetPlugin("server").(*reloadTestPlugin)
+	other := m.GetPlugin("other").(*reloadTestPlugin)
+	dial()
+
+	// "other" is changed. "server" is reused and keeps listening.
+	writeCfg(2, false)
+	if code := reload(); code != http.StatusOK {
+		t.Fatalf("reload failed, status %d", code)
+	}
+	cur := m.Current()
+	if cur == m {
+		t.Fatal("plugins were not replaced")
+	}
+	if cur.GetPlugin("server") != server {
+		t.Fatal("unchanged plugin was not reused")
+	}
+	newOther := cur.GetPlugin("other").(*reloadTestPlugin)
+	if newOther == other {
+		t.Fatal("changed plugin was reused")
+	}
+	dial()
+	deadline := time.Now().Add(time.Second * 2)
+	for !other.closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("replaced plugin was not closed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if server.closed.Load() {
+		t.Fatal("reused plugin was closed")
+	}
+
+	// A failed reload keeps the current plugins.
+	writeCfg(3, true)
+	if code := reload(); code != http.StatusInternalServerError {
+		t.Fatalf("want reload error, got status %d", code)
+	}
+	if m.Current() != cur {
+		t.Fatal("plugins were replaced by a failed reload")
+	}
+	if cur.GetPlugin("server") != server || cur.GetPlugin("other") != newOther {
+		t.Fatal("plugins were changed by a failed reload")
+	}
+	if server.closed.Load() || newOther.closed.Load() {
+		t.Fatal("current plugins were closed by a failed reload")
+	}
+	dial()
+}
@@ -68,8 +68,10 @@ func init() {
 				signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 				sig := <-c
 				m.logger.Warn("signal received", zap.Stringer("signal", sig))
-				m.sc.SendCloseSignal(nil)
+				m.sh.sc.SendCloseSignal(nil)
 			}()
+			reloadOnSignal(m)
+			reopenLogsOnSignal(m)
 			return m.GetSafeClose().WaitClosed()
 		},
 		DisableFlagsInUseLine: true,
@@ -126,7 +128,24 @@ func NewServer(sf *serverFlags) (*Mosdns, error) {
 	}
 	mlog.L().Info("main config loaded", zap.String("file", fileUsed))
 
-	return NewMosdns(cfg)
+	m, err := NewMosdns(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.sh.cfgFile = fileUsed
+	return m, nil
+}
+
+// reloadOnSignal reloads m when SIGHUP is received.
+func reloadOnSignal(m *Mosdns) {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for sig := range c {
+			m.logger.Info("signal received", zap.Stringer("signal", sig))
+			_ = m.Reload() // Reload logs its error.
+		}
+	}()
 }
 
 // loadConfig load a config from a file. If filePath is empty, it will
@@ -145,10 +164,20 @@ func loadConfig(filePath string) (*Config, string, error) {
 		return nil, "", fmt.Errorf("failed to read config: %w", err)
 	}
 
+	// Expand ${...} variables in all string values.
+	for k, val := range v.AllSettings() {
+		nv, err := expandConfigValue(val, k)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to expand config: %w", err)
+		}
+		v.Set(k, nv)
+	}
+
 	decoderOpt := func(cfg *mapstructure.DecoderConfig) {
 		cfg.ErrorUnused = true
 		cfg.TagName = "yaml"
 		cfg.WeaklyTypedInput = true
+		cfg.DecodeHook = mapstructure.ComposeDecodeHookFunc(includeDecodeHook, cfg.DecodeHook)
 	}
 
 	cfg := new(Config)
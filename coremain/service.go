@@ -52,6 +52,8 @@ func (ss *serverService) Start(s service.Service) error {
 		return err
 	}
 	ss.m = m
+	reloadOnSignal(m)
+	reopenLogsOnSignal(m)
 	go func() {
 		err := m.GetSafeClose().WaitClosed()
 		if err != nil {
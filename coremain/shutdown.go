@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AcceptStopper is implemented by server plugins that can stop accepting
+// new queries while still being able to respond queries that are being
+// handled. Close will be called once these queries are done.
+type AcceptStopper interface {
+	StopAccepting()
+}
+
+// shutdown closes all plugins in m gracefully.
+// Servers stop accepting new queries first. Then it waits up to timeout
+// for queries that are being handled. Finally, plugins are closed in reverse
+// dependency order.
+func (m *Mosdns) shutdown(timeout time.Duration) {
+	m.stopAcceptingExcept(nil)
+	if n := m.inflight.Load(); n > 0 {
+		m.logger.Info("waiting for queries to be done", zap.Int64("queries", n), zap.Duration("timeout", timeout))
+		m.drain(timeout, nil)
+	}
+	m.closePluginsExcept(nil)
+}
+
+// stopAcceptingExcept stops servers in m except those in skip.
+func (m *Mosdns) stopAcceptingExcept(skip map[string]struct{}) {
+	for _, tag := range m.order {
+		if _, ok := skip[tag]; ok {
+			continue
+		}
+		if s, ok := m.plugins[tag].(AcceptStopper); ok {
+			m.logger.Info("stop accepting queries", zap.String("tag", tag))
+			s.StopAccepting()
+		}
+	}
+}
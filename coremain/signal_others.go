@@ -0,0 +1,46 @@
+//go:build !windows
+
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package coremain
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"go.uber.org/zap"
+)
+
+// reopenLogsOnSignal reopens log files when SIGUSR1 is received.
+// It is used by external log rotators.
+func reopenLogsOnSignal(m *Mosdns) {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGUSR1)
+		for sig := range c {
+			m.logger.Info("signal received, reopening log files", zap.Stringer("signal", sig))
+			if err := mlog.ReopenFiles(); err != nil {
+				m.logger.Error("failed to reopen log files", zap.Error(err))
+			}
+		}
+	}()
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Levels is the log level of a logger from NewLoggerWithLevels.
+// It has a global level and per-logger overrides. Both can be changed
+// at runtime.
+// An override applies to the logger with the same name and its sub-loggers.
+// e.g. An override for "forward" also applies to "forward.r0".
+type Levels struct {
+	global zap.AtomicLevel
+
+	mu        sync.Mutex // serializes overrides writers.
+	overrides atomic.Pointer[map[string]zapcore.Level]
+}
+
+func newLevels(l zapcore.Level) *Levels {
+	lv := &Levels{global: zap.NewAtomicLevelAt(l)}
+	lv.overrides.Store(new(map[string]zapcore.Level))
+	return lv
+}
+
+// Global returns the global level. It is a http.Handler that can get and
+// set the level. See zap.AtomicLevel.ServeHTTP.
+func (lv *Levels) Global() zap.AtomicLevel {
+	return lv.global
+}
+
+// Overrides returns a copy of current per-logger overrides.
+func (lv *Levels) Overrides() map[string]zapcore.Level {
+	return maps.Clone(*lv.overrides.Load())
+}
+
+// SetOverride sets the level of the logger with the name.
+func (lv *Levels) SetOverride(name string, l zapcore.Level) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	m := maps.Clone(*lv.overrides.Load())
+	if m == nil {
+		m = make(map[string]zapcore.Level)
+	}
+	m[name] = l
+	lv.overrides.Store(&m)
+}
+
+// DeleteOverride deletes the override of the logger with the name.
+// The logger will use the global level.
+func (lv *Levels) DeleteOverride(name string) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	m := maps.Clone(*lv.overrides.Load())
+	delete(m, name)
+	lv.overrides.Store(&m)
+}
+
+// minEnabled reports whether l is enabled by the global level
+// or any override.
+func (lv *Levels) minEnabled(l zapcore.Level) bool {
+	if lv.global.Enabled(l) {
+		return true
+	}
+	for _, ol := range *lv.overrides.Load() {
+		if ol.Enabled(l) {
+			return true
+		}
+	}
+	return false
+}
+
+// enabled reports whether l is enabled for the logger with the name.
+func (lv *Levels) enabled(name string, l zapcore.Level) bool {
+	overrides := *lv.overrides.Load()
+	if len(overrides) > 0 {
+		for n := name; len(n) > 0; {
+			if ol, ok := overrides[n]; ok {
+				return ol.Enabled(l)
+			}
+			i := strings.LastIndexByte(n, '.')
+			if i < 0 {
+				break
+			}
+			n = n[:i]
+		}
+	}
+	return lv.global.Enabled(l)
+}
+
+// levelCore is a zapcore.Core that checks entries with Levels.
+type levelCore struct {
+	zapcore.Core // inner core must enable all levels.
+	lv           *Levels
+}
+
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.lv.minEnabled(l)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), lv: c.lv}
+}
+
+func (c *levelCore) Check(e zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.lv.enabled(e.LoggerName, e.Level) {
+		return ce.AddCore(e, c)
+	}
+	return ce
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestLevels(t *testing.T) {
+	lv := newLevels(zap.InfoLevel)
+	obs, logs := observer.New(zapcore.DebugLevel)
+	l := zap.New(&levelCore{Core: obs, lv: lv})
+
+	l.Named("forward").Debug("dropped")
+	lv.SetOverride("forward", zap.DebugLevel)
+	l.Named("forward").Debug("forward")
+	l.Named("forward").Named("r0").Debug("sub logger")
+	l.Named("forward_remote").Debug("dropped")
+	l.Named("cache").Debug("dropped")
+	lv.Global().SetLevel(zap.ErrorLevel)
+	l.Named("cache").Info("dropped")
+	lv.DeleteOverride("forward")
+	l.Named("forward").Debug("dropped")
+
+	var got []string
+	for _, e := range logs.All() {
+		got = append(got, e.Message)
+	}
+	if len(got) != 2 || got[0] != "forward" || got[1] != "sub logger" {
+		t.Fatalf("unexpected logs %v", got)
+	}
+}
@@ -34,8 +34,15 @@ type LogConfig struct {
 	// Default is stderr.
 	File string `yaml:"file"`
 
+	// Rotate configures the rotation of File.
+	Rotate RotateConfig `yaml:"rotate"`
+
 	// Production enables json output.
 	Production bool `yaml:"production"`
+
+	// PluginLevels overrides Level for plugins. It is a map of plugin
+	// tags and their levels.
+	PluginLevels map[string]string `yaml:"plugin_levels"`
 }
 
 var (
@@ -48,26 +55,52 @@ var (
 )
 
 func NewLogger(lc LogConfig) (*zap.Logger, error) {
+	l, _, err := NewLoggerWithLevels(lc)
+	return l, err
+}
+
+// NewLoggerWithLevels is like NewLogger but also returns the Levels of
+// the logger, which can be changed at runtime.
+func NewLoggerWithLevels(lc LogConfig) (*zap.Logger, *Levels, error) {
 	lvl, err := zapcore.ParseLevel(lc.Level)
 	if err != nil {
-		return nil, fmt.Errorf("invalid log level: %w", err)
+		return nil, nil, fmt.Errorf("invalid log level: %w", err)
+	}
+	lv := newLevels(lvl)
+	for tag, s := range lc.PluginLevels {
+		l, err := zapcore.ParseLevel(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid log level for plugin %s: %w", tag, err)
+		}
+		lv.SetOverride(tag, l)
 	}
 
 	var out zapcore.WriteSyncer
-	if lf := lc.File; len(lf) > 0 {
-		f, _, err := zap.Open(lf)
+	switch lf := lc.File; lf {
+	case "":
+		out = stderr
+	case "stdout", "stderr": // special paths of zap.Open
+		ws, _, err := zap.Open(lf)
 		if err != nil {
-			return nil, fmt.Errorf("open log file: %w", err)
+			return nil, nil, fmt.Errorf("open log file: %w", err)
 		}
-		out = zapcore.Lock(f)
-	} else {
-		out = stderr
+		out = ws
+	default:
+		f, err := OpenFile(lf, lc.Rotate)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open log file: %w", err)
+		}
+		out = zapcore.AddSync(f) // f is safe for concurrent use.
 	}
 
+	var enc zapcore.Encoder
 	if lc.Production {
-		return zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), out, lvl)), nil
+		enc = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	} else {
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
 	}
-	return zap.New(zapcore.NewCore(zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()), out, lvl)), nil
+	core := &levelCore{Core: zapcore.NewCore(enc, out, zapcore.DebugLevel), lv: lv}
+	return zap.New(core), lv, nil
 }
 
 // L is a global logger.
@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+// RotateConfig configures the rotation of a RotateWriter.
+// Zero value disables rotation.
+type RotateConfig struct {
+	// MaxSize is the maximum size in megabytes of the file before
+	// it gets rotated.
+	MaxSize int `yaml:"max_size"`
+
+	// MaxAge is the maximum time in hours that a file can be written
+	// to before it gets rotated. The age of an existing file counts from
+	// its creation (or modification, if the file system does not record
+	// creation times), so restarts and reopens don't reset it.
+	MaxAge int `yaml:"max_age"`
+
+	// MaxBackups is the maximum number of rotated files to retain.
+	// Older files are removed. Default (0) is to retain all.
+	MaxBackups int `yaml:"max_backups"`
+
+	// Compress rotated files with gzip.
+	Compress bool `yaml:"compress"`
+}
+
+const backupTimeFormat = "20060102T150405.000"
+
+var (
+	openWritersMu sync.Mutex
+	openWriters   = make(map[*RotateWriter]struct{})
+)
+
+// ReopenFiles reopens all files opened by OpenFile. It should be called
+// after the files were moved by external rotators (e.g. logrotate).
+func ReopenFiles() error {
+	openWritersMu.Lock()
+	defer openWritersMu.Unlock()
+	var errs []error
+	for w := range openWriters {
+		if err := w.Reopen(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RotateWriter is an io.Writer that writes to a file and rotates it.
+// Rotated files are renamed to "name-<time>.ext" in the same dir.
+// It is safe for concurrent use.
+type RotateWriter struct {
+	path string
+	cfg  RotateConfig
+
+	mu        sync.Mutex
+	f         *os.File
+	size      int64
+	createdAt time.Time // when the current file was created.
+
+	millMu sync.Mutex // serializes compressing and removing old files.
+}
+
+// OpenFile opens a RotateWriter for path. Plugins that write their own
+// file should use it as well, so the file is rotated in the same way
+// and can be reopened by ReopenFiles.
+// The writer must be closed by Close.
+func OpenFile(path string, cfg RotateConfig) (*RotateWriter, error) {
+	w := &RotateWriter{path: path, cfg: cfg}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	openWritersMu.Lock()
+	openWriters[w] = struct{}{}
+	openWritersMu.Unlock()
+	return w, nil
+}
+
+// open opens w.path in append mode. Caller must hold w.mu.
+func (w *RotateWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	w.createdAt = time.Now()
+	if fi.Size() > 0 { // An existing file.
+		w.createdAt = fileCreatedAt(w.path, fi)
+	}
+	return nil
+}
+
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return 0, os.ErrClosed
+	}
+	if w.needRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, fmt.Errorf("failed to rotate log file, %w", err)
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotateWriter) needRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.cfg.MaxSize > 0 && w.size+int64(n) > int64(w.cfg.MaxSize)<<20 {
+		return true
+	}
+	if w.cfg.MaxAge > 0 && time.Since(w.createdAt) > time.Duration(w.cfg.MaxAge)*time.Hour {
+		return true
+	}
+	return false
+}
+
+// rotate renames the current file and opens a new one. Caller must hold w.mu.
+func (w *RotateWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+	renameErr := os.Rename(w.path, w.backupName(time.Now()))
+	if err := w.open(); err != nil {
+		return err
+	}
+	if renameErr != nil { // Keep writing to the current file.
+		return renameErr
+	}
+	go w.mill()
+	return nil
+}
+
+func (w *RotateWriter) backupName(t time.Time) string {
+	dir, name := filepath.Split(w.path)
+	ext := filepath.Ext(name)
+	return filepath.Join(dir, fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), t.Format(backupTimeFormat), ext))
+}
+
+// backups returns rotated files of w, from newest to oldest.
+func (w *RotateWriter) backups() ([]string, error) {
+	dir, name := filepath.Split(w.path)
+	ext := filepath.Ext(name)
+	prefix := strings.TrimSuffix(name, ext) + "-"
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		n := e.Name()
+		ts, ok := strings.CutPrefix(n, prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		ts = strings.TrimSuffix(strings.TrimSuffix(ts, ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, ts); err != nil {
+			continue
+		}
+		files = append(files, filepath.Join(dir, n))
+	}
+	// Time format is sortable. Newest first.
+	slices.Sort(files)
+	slices.Reverse(files)
+	return files, nil
+}
+
+// mill compresses rotated files and removes old files.
+func (w *RotateWriter) mill() {
+	w.millMu.Lock()
+	defer w.millMu.Unlock()
+
+	files, err := w.backups()
+	if err != nil {
+		return
+	}
+	if w.cfg.MaxBackups > 0 && len(files) > w.cfg.MaxBackups {
+		for _, f := range files[w.cfg.MaxBackups:] {
+			_ = os.Remove(f)
+		}
+		files = files[:w.cfg.MaxBackups]
+	}
+	if w.cfg.Compress {
+		for _, f := range files {
+			if !strings.HasSuffix(f, ".gz") {
+				_ = compressFile(f)
+			}
+		}
+	}
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(dst)
+	_, err = io.Copy(gw, src)
+	if err == nil {
+		err = gw.Close()
+	}
+	if cErr := dst.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
+
+// Reopen closes and reopens the file. The file will be created
+// if it was moved or removed.
+func (w *RotateWriter) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	_ = w.f.Close()
+	w.f = nil
+	return w.open()
+}
+
+// Sync commits the file to stable storage.
+func (w *RotateWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	return w.f.Sync()
+}
+
+func (w *RotateWriter) Close() error {
+	openWritersMu.Lock()
+	delete(openWriters, w)
+	openWritersMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package mlog
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "mosdns.log")
+	w, err := OpenFile(p, RotateConfig{MaxSize: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	b := bytes.Repeat([]byte{'a'}, 600<<10)
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * 2) // different backup names
+	}
+
+	var backups []string
+	for i := 0; i < 100; i++ { // wait for mill
+		backups, err = w.backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("want 2 backups, got %v", backups)
+	}
+
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(b)) {
+		t.Fatalf("unexpected file size %d", fi.Size())
+	}
+
+	// Reopen after the file was moved.
+	if err := os.Rename(p, p+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(p); err != nil || fi.Size() != 5 {
+		t.Fatalf("file was not reopened, %v", err)
+	}
+}
+
+func TestRotateWriter_maxAge(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "mosdns.log")
+	if err := os.WriteFile(p, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 20)
+	beforeOpen := time.Now()
+
+	w, err := OpenFile(p, RotateConfig{MaxAge: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// The age of an existing file is not reset by opens.
+	createdAt := w.createdAt
+	if !createdAt.Before(beforeOpen) {
+		t.Fatalf("age of the existing file counts from the open, %s >= %s", createdAt, beforeOpen)
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if !w.createdAt.Equal(createdAt) {
+		t.Fatalf("age was reset by reopen, %s != %s", w.createdAt, createdAt)
+	}
+
+	// Rotated by age.
+	w.createdAt = time.Now().Add(-time.Hour * 2)
+	if _, err := w.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "new\n" {
+		t.Fatalf("file was not rotated, got %q", b)
+	}
+}
+
+func TestRotateWriter_compress(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "mosdns.log")
+	w, err := OpenFile(p, RotateConfig{MaxSize: 1, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	b := bytes.Repeat([]byte{'a'}, 600<<10)
+	for i := 0; i < 2; i++ {
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backups []string
+	for i := 0; i < 100; i++ { // wait for mill
+		backups, err = w.backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) == 1 && strings.HasSuffix(backups[0], ".gz") {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+		t.Fatalf("want 1 compressed backup, got %v", backups)
+	}
+	if _, err := os.Stat(strings.TrimSuffix(backups[0], ".gz")); !os.IsNotExist(err) {
+		t.Fatalf("uncompressed backup was not removed, %v", err)
+	}
+
+	f, err := os.Open(backups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("unexpected backup content, %d bytes", len(got))
+	}
+}
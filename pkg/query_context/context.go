@@ -20,6 +20,8 @@
 package query_context
 
 import (
+	"maps"
+	"slices"
 	"sync/atomic"
 	"time"
 
@@ -49,6 +51,8 @@ type Context struct {
 	respOpt     *dns.OPT // nil if clientOpt == nil
 	upstreamOpt *dns.OPT // may be nil
 
+	dryRun bool
+
 	// lazy init.
 	kv    map[uint32]any
 	marks map[uint32]struct{}
@@ -187,12 +191,37 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 		d.respOpt = dns.Copy(ctx.respOpt).(*dns.OPT)
 	}
 	d.upstreamOpt = ctx.upstreamOpt
+	d.dryRun = ctx.dryRun
 
 	d.kv = copyMap(ctx.kv)
 	d.marks = copyMap(ctx.marks)
 	return d
 }
 
+// MergeFrom copies marks and values of src to this Context.
+// Values that exist in both Contexts are overwritten by src's.
+// Like CopyTo, values are not deep-copied.
+func (ctx *Context) MergeFrom(src *Context) {
+	for k, v := range src.kv {
+		ctx.StoreValue(k, v)
+	}
+	for m := range src.marks {
+		ctx.SetMark(m)
+	}
+}
+
+// SetDryRun marks this Context as a dry run (e.g. a trace from the api).
+// The query is still executed, but plugins should not write any
+// persistent state (e.g. cache entries) for it.
+func (ctx *Context) SetDryRun() {
+	ctx.dryRun = true
+}
+
+// DryRun reports whether this Context was marked by SetDryRun.
+func (ctx *Context) DryRun() bool {
+	return ctx.dryRun
+}
+
 // StoreValue stores any v in to this Context
 // k MUST from RegKey.
 func (ctx *Context) StoreValue(k uint32, v any) {
@@ -227,6 +256,11 @@ func (ctx *Context) HasMark(m uint32) bool {
 	return ok
 }
 
+// Marks returns all marks in ascending order.
+func (ctx *Context) Marks() []uint32 {
+	return slices.Sorted(maps.Keys(ctx.marks))
+}
+
 // DeleteMark deletes mark m from this Context.
 func (ctx *Context) DeleteMark(m uint32) {
 	delete(ctx.marks, m)
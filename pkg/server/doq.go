@@ -41,6 +41,12 @@ const (
 type DoQServerOpts struct {
 	Logger      *zap.Logger
 	IdleTimeout time.Duration
+
+	// BaseContext is the parent context of all queries. If it is set,
+	// queries that are being handled will not be canceled when the server
+	// returns, so they can still be responded (graceful shutdown).
+	// Default: queries are canceled when the server returns.
+	BaseContext context.Context
 }
 
 // ServeDoQ starts a server at l. It returns if l had an Accept() error.
@@ -55,7 +61,7 @@ func ServeDoQ(l *quic.Listener, h Handler, opts DoQServerOpts) error {
 		idleTimeout = defaultQuicIdleTimeout
 	}
 
-	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	listenerCtx, cancel := listenerContext(opts.BaseContext)
 	defer cancel(errListenerCtxCanceled)
 	for {
 		c, err := l.Accept(listenerCtx)
@@ -43,6 +43,12 @@ type TCPServerOpts struct {
 
 	// Default is defaultTCPIdleTimeout.
 	IdleTimeout time.Duration
+
+	// BaseContext is the parent context of all queries. If it is set,
+	// queries that are being handled will not be canceled when the server
+	// returns, so they can still be responded (graceful shutdown).
+	// Default: queries are canceled when the server returns.
+	BaseContext context.Context
 }
 
 // ServeTCP starts a server at l. It returns if l had an Accept() error.
@@ -61,7 +67,7 @@ func ServeTCP(l net.Listener, h Handler, opts TCPServerOpts) error {
 		firstReadTimeout = idleTimeout
 	}
 
-	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	listenerCtx, cancel := listenerContext(opts.BaseContext)
 	defer cancel(errListenerCtxCanceled)
 	for {
 		c, err := l.Accept()
@@ -31,6 +31,18 @@ import (
 
 type UDPServerOpts struct {
 	Logger *zap.Logger
+
+	// BaseContext is the parent context of all queries. If it is set,
+	// queries that are being handled will not be canceled when the server
+	// returns, so they can still be responded (graceful shutdown).
+	// Default: queries are canceled when the server returns.
+	BaseContext context.Context
+
+	// ResponseConn, if set, returns the conn that responses are written to.
+	// It is called for each response. e.g. After c was closed, responses
+	// can be written via another socket of the same address.
+	// Default is c.
+	ResponseConn func() *net.UDPConn
 }
 
 // ServeUDP starts a server at c. It returns if c had a read error.
@@ -42,7 +54,7 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 		logger = nopLogger
 	}
 
-	listenerCtx, cancel := context.WithCancelCause(context.Background())
+	listenerCtx, cancel := listenerContext(opts.BaseContext)
 	defer cancel(errListenerCtxCanceled)
 
 	rb := pool.GetBuf(dns.MaxMsgSize)
@@ -98,7 +110,11 @@ func ServeUDP(c *net.UDPConn, h Handler, opts UDPServerOpts) error {
 			if oobWriter != nil && dstIpFromCm != nil {
 				oob = oobWriter(dstIpFromCm)
 			}
-			if _, _, err := c.WriteMsgUDPAddrPort(*payload, oob, remoteAddr); err != nil {
+			wc := c
+			if opts.ResponseConn != nil {
+				wc = opts.ResponseConn()
+			}
+			if _, _, err := wc.WriteMsgUDPAddrPort(*payload, oob, remoteAddr); err != nil {
 				logger.Warn("failed to write response", zap.Stringer("client", remoteAddr), zap.Error(err))
 			}
 		}()
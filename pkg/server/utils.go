@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"errors"
 
 	"go.uber.org/zap"
@@ -14,3 +15,14 @@ var (
 var (
 	nopLogger = zap.NewNop()
 )
+
+// listenerContext returns the parent context of all queries of a listener.
+// If base is nil, the returned context should be canceled when the listener
+// returns. Otherwise, base is returned and cancel is a noop, queries
+// will only be canceled by base.
+func listenerContext(base context.Context) (context.Context, context.CancelCauseFunc) {
+	if base != nil {
+		return base, func(error) {}
+	}
+	return context.WithCancelCause(context.Background())
+}
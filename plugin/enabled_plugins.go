@@ -29,6 +29,7 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/client_ip"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/cname"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/env"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/expr"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/has_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/has_wanted_ans"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/matcher/ptr_ip"
@@ -57,14 +58,19 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/retry"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/fallback"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/parallel"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sub_query"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/timeout"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ttl"
 
 	// executable and matcher
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/mark"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/switcher"
 
 	// server
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/server/http_server"
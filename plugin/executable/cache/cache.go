@@ -89,6 +89,7 @@ type Cache struct {
 	closeOnce    sync.Once
 	closeNotify  chan struct{}
 	updatedKey   atomic.Uint64
+	dumpErr      atomic.Pointer[error] // error from loading the dump file.
 
 	queryTotal   prometheus.Counter
 	hitTotal     prometheus.Counter
@@ -97,16 +98,39 @@ type Cache struct {
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
+	a := args.(*Args)
+	if bp.M().DryRun() { // Don't read or write the dump file.
+		ac := *a
+		ac.DumpFile = ""
+		a = &ac
+	}
+	c := NewCache(a, Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
 	})
 
+	if err := c.register(bp); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+var _ coremain.ReusablePlugin = (*Cache)(nil)
+var _ coremain.HealthReporter = (*Cache)(nil)
+
+// ReuseIn implements coremain.ReusablePlugin.
+// Cached records are kept across reloads.
+func (c *Cache) ReuseIn(bp *coremain.BP) error {
+	return c.register(bp)
+}
+
+// register registers metrics and api of c to bp.
+func (c *Cache) register(bp *coremain.BP) error {
 	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
-		return nil, fmt.Errorf("failed to register metrics, %w", err)
+		return fmt.Errorf("failed to register metrics, %w", err)
 	}
 	bp.RegAPI(c.Api())
-	return c, nil
+	return nil
 }
 
 // QuickSetup format: [size]
@@ -171,6 +195,9 @@ func NewCache(args *Args, opts Opts) *Cache {
 
 	if err := p.loadDump(); err != nil {
 		p.logger.Error("failed to load cache dump", zap.Error(err))
+		if !errors.Is(err, os.ErrNotExist) { // No dump file yet is not an error.
+			p.dumpErr.Store(&err)
+		}
 	}
 	p.startDumpLoop()
 
@@ -198,7 +225,9 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
 	if lazyHit {
 		c.lazyHitTotal.Inc()
-		c.doLazyUpdate(msgKey, qCtx, next)
+		if !qCtx.DryRun() { // Lazy update stores the response.
+			c.doLazyUpdate(msgKey, qCtx, next)
+		}
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
@@ -208,6 +237,9 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 
 	err := next.ExecNext(ctx, qCtx)
 
+	if qCtx.DryRun() {
+		return err
+	}
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
 		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
 		c.updatedKey.Add(1)
@@ -243,6 +275,15 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
+// Health implements coremain.HealthReporter.
+// It returns an error if the dump file failed to load.
+func (c *Cache) Health() error {
+	if errp := c.dumpErr.Load(); errp != nil {
+		return fmt.Errorf("failed to load cache dump, %w", *errp)
+	}
+	return nil
+}
+
 func (c *Cache) Close() error {
 	if err := c.dumpCache(); err != nil {
 		c.logger.Error("failed to dump cache", zap.Error(err))
@@ -335,6 +376,7 @@ func (c *Cache) Api() *chi.Mux {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		c.dumpErr.Store(nil)
 		w.WriteHeader(http.StatusOK)
 	})
 	return r
@@ -21,7 +21,13 @@ package cache
 
 import (
 	"bytes"
+	"context"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"github.com/miekg/dns"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -60,3 +66,71 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_cachePlugin_Health(t *testing.T) {
+	dir := t.TempDir()
+
+	// Missing dump file is fine.
+	c := NewCache(&Args{DumpFile: filepath.Join(dir, "not_exist")}, Opts{})
+	defer c.Close()
+	if err := c.Health(); err != nil {
+		t.Fatalf("unexpected health err: %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad")
+	if err := os.WriteFile(bad, []byte("not a dump"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c2 := NewCache(&Args{DumpFile: bad}, Opts{})
+	defer c2.Close()
+	if err := c2.Health(); err == nil {
+		t.Fatal("want health err for invalid dump file")
+	}
+}
+
+type respSetter struct{ r *dns.Msg }
+
+func (s *respSetter) Exec(_ context.Context, qCtx *query_context.Context) error {
+	qCtx.SetResponse(s.r.Copy())
+	return nil
+}
+
+func Test_cachePlugin_DryRun(t *testing.T) {
+	c := NewCache(&Args{Size: 1024}, Opts{})
+	defer c.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+	})
+
+	ps := map[string]any{"cache": c, "resp": &respSetter{r: r}}
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	s, err := sequence.NewSequence(coremain.NewBP("test", m), []sequence.RuleArgs{
+		{Exec: "$cache"},
+		{Exec: "$resp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		qCtx := query_context.NewContext(q.Copy())
+		if err := s.ExecTrace(context.Background(), qCtx, &sequence.Trace{DryRun: dryRun}); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.R() == nil {
+			t.Fatalf("dry run %v: missing response", dryRun)
+		}
+		want := 1
+		if dryRun {
+			want = 0
+		}
+		if n := c.backend.Len(); n != want {
+			t.Fatalf("dry run %v: cache has %d entries, want %d", dryRun, n, want)
+		}
+	}
+}
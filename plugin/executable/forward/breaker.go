@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultOpenTimeout = 30 // seconds
+)
+
+// BreakerArgs configures the circuit breaker of each upstream.
+type BreakerArgs struct {
+	// Failures is the number of consecutive failed queries that trips the
+	// breaker. Rejected responses (see RejectArgs) are also failures.
+	// An upstream with an open breaker is skipped. Default is 0, which
+	// disables the breaker.
+	Failures int `yaml:"failures"`
+
+	// OpenTimeout is the seconds that an upstream is skipped after the
+	// breaker is tripped. Default is 30.
+	// After that, if ProbeDomain is empty, the breaker is half-open and
+	// the next query is sent to the upstream as a trial. Otherwise, a
+	// probe query is sent. The breaker is closed if the trial or probe
+	// query succeeded, or opened again.
+	OpenTimeout int `yaml:"open_timeout"`
+
+	// ProbeDomain is the name of probe queries (type A).
+	ProbeDomain string `yaml:"probe_domain"`
+}
+
+type breakerState int32
+
+const (
+	stateClosed breakerState = iota
+	stateOpen
+	stateHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case stateClosed:
+		return "closed"
+	case stateOpen:
+		return "open"
+	case stateHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// breaker is a circuit breaker driven by results of queries.
+type breaker struct {
+	threshold   int64
+	openTimeout time.Duration
+	// queryTimeout is the timeout of probes. A half-open trial that takes
+	// longer is given up.
+	queryTimeout time.Duration
+	probe        func(ctx context.Context) error // nil if probing is disabled.
+
+	state    atomic.Int32 // breakerState
+	openedAt atomic.Int64 // unix nano
+	trialAt  atomic.Int64 // unix nano, when the half-open trial was taken.
+	trips    atomic.Uint64
+	probing  atomic.Bool
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+func newBreaker(args BreakerArgs, uw *upstreamWrapper) *breaker {
+	b := &breaker{
+		queryTimeout: uw.timeout,
+		threshold:    int64(args.Failures),
+		openTimeout:  time.Duration(args.OpenTimeout) * time.Second,
+		closeCh:      make(chan struct{}),
+	}
+	if name := args.ProbeDomain; len(name) > 0 {
+		b.probe = func(ctx context.Context) error { return uw.probe(ctx, name) }
+	}
+	return b
+}
+
+func (b *breaker) getState() breakerState {
+	return breakerState(b.state.Load())
+}
+
+// allow reports whether a query can be sent. If the breaker is open and
+// the open timeout elapsed, the first caller gets the half-open trial.
+// The caller must send the trial query, or call releaseTrial.
+func (b *breaker) allow() bool {
+	switch b.getState() {
+	case stateClosed:
+		return true
+	case stateOpen:
+		if b.probe != nil || time.Since(time.Unix(0, b.openedAt.Load())) < b.openTimeout {
+			return false
+		}
+		if !b.state.CompareAndSwap(int32(stateOpen), int32(stateHalfOpen)) {
+			return false
+		}
+		b.trialAt.Store(time.Now().UnixNano())
+		return true
+	default:
+		// The trial is running. If it takes too long, it is lost somehow,
+		// the next caller takes it over.
+		t := b.trialAt.Load()
+		if time.Since(time.Unix(0, t)) < b.queryTimeout {
+			return false
+		}
+		return b.trialAt.CompareAndSwap(t, time.Now().UnixNano())
+	}
+}
+
+// releaseTrial gives up the half-open trial that was not sent or was
+// cancelled, so the next query can take it.
+func (b *breaker) releaseTrial() {
+	b.state.CompareAndSwap(int32(stateHalfOpen), int32(stateOpen))
+}
+
+func (b *breaker) onSuccess() {
+	b.state.Store(int32(stateClosed))
+}
+
+// onFailure is called with the number of consecutive failures.
+func (b *breaker) onFailure(failures int64) {
+	switch b.getState() {
+	case stateClosed:
+		if failures >= b.threshold && b.state.CompareAndSwap(int32(stateClosed), int32(stateOpen)) {
+			b.open()
+		}
+	case stateHalfOpen:
+		if b.state.CompareAndSwap(int32(stateHalfOpen), int32(stateOpen)) {
+			b.open()
+		}
+	}
+}
+
+func (b *breaker) open() {
+	b.openedAt.Store(time.Now().UnixNano())
+	b.trips.Add(1)
+	if b.probe != nil && b.probing.CompareAndSwap(false, true) {
+		go b.probeLoop()
+	}
+}
+
+// probeLoop sends probe queries until one succeeded or the breaker is
+// closed by a query.
+func (b *breaker) probeLoop() {
+	for {
+		for b.getState() == stateOpen {
+			timer := pool.GetTimer(b.openTimeout)
+			select {
+			case <-timer.C:
+				pool.ReleaseTimer(timer)
+			case <-b.closeCh:
+				pool.ReleaseTimer(timer)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), b.queryTimeout)
+			err := b.probe(ctx)
+			cancel()
+			if err == nil {
+				b.onSuccess()
+			} else {
+				b.openedAt.Store(time.Now().UnixNano())
+			}
+		}
+		b.probing.Store(false)
+		// The breaker may be tripped again before probing was cleared.
+		if b.getState() != stateOpen || !b.probing.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+func (b *breaker) close() {
+	b.closeOnce.Do(func() { close(b.closeCh) })
+}
+
+// probe sends a probe query to the upstream. Any response is a success.
+func (uw *upstreamWrapper) probe(ctx context.Context, name string) error {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		return err
+	}
+	defer pool.ReleaseBuf(b)
+	r, err := uw.u.ExchangeContext(ctx, *b)
+	if err != nil {
+		return err
+	}
+	pool.ReleaseBuf(r)
+	return nil
+}
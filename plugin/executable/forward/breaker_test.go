@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream replies to queries after delay, or fails if fail is set.
+// If reply is set, it makes the response.
+type fakeUpstream struct {
+	fail  atomic.Bool
+	calls atomic.Int64
+	delay time.Duration
+	reply func(q *dns.Msg) *dns.Msg
+}
+
+func (u *fakeUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	u.calls.Add(1)
+	if u.delay > 0 {
+		select {
+		case <-time.After(u.delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if u.fail.Load() {
+		return nil, errors.New("fake error")
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	if u.reply != nil {
+		return pool.PackBuffer(u.reply(q))
+	}
+	return pool.PackBuffer(new(dns.Msg).SetReply(q))
+}
+
+func (u *fakeUpstream) Close() error { return nil }
+
+func newTestForward(t *testing.T, breaker BreakerArgs, us ...*fakeUpstream) *Forward {
+	t.Helper()
+	return newTestForwardWithArgs(t, &Args{Breaker: breaker}, us...)
+}
+
+func newTestForwardWithArgs(t *testing.T, args *Args, us ...*fakeUpstream) *Forward {
+	t.Helper()
+	for range us {
+		args.Upstreams = append(args.Upstreams, UpstreamConfig{Addr: "127.0.0.1"})
+	}
+	f, err := NewForward(args, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, uw := range f.us {
+		_ = uw.u.Close()
+		uw.u = us[i]
+		if uw.breaker != nil {
+			uw.breaker.openTimeout = time.Millisecond * 100
+		}
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+func exchangeN(f *Forward, n int) {
+	for i := 0; i < n; i++ {
+		qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		_ = f.Exec(context.Background(), qCtx)
+	}
+}
+
+func TestForward_breaker(t *testing.T) {
+	bad, good := new(fakeUpstream), new(fakeUpstream)
+	bad.fail.Store(true)
+	f := newTestForward(t, BreakerArgs{Failures: 2}, bad, good)
+	b := f.us[0].breaker
+
+	exchangeN(f, 50)
+	if n := bad.calls.Load(); n != 2 {
+		t.Fatalf("bad upstream should be skipped after 2 failures, got %d calls", n)
+	}
+	if s := b.getState(); s != stateOpen {
+		t.Fatalf("breaker state = %s, want open", s)
+	}
+	if f.us[0].reachable() {
+		t.Fatal("upstream with an open breaker should be unreachable")
+	}
+
+	// Half-open trial failed.
+	time.Sleep(b.openTimeout)
+	exchangeN(f, 50)
+	if n := bad.calls.Load(); n != 3 {
+		t.Fatalf("want 1 trial query, got %d calls", n-2)
+	}
+
+	// Half-open trial succeeded.
+	bad.fail.Store(false)
+	time.Sleep(b.openTimeout)
+	exchangeN(f, 50)
+	if s := b.getState(); s != stateClosed {
+		t.Fatalf("breaker state = %s, want closed", s)
+	}
+	if trips := b.trips.Load(); trips != 2 {
+		t.Fatalf("trips = %d, want 2", trips)
+	}
+}
+
+// Rejected responses are failures of the upstream.
+func TestForward_breakerRejected(t *testing.T) {
+	servfail := func(q *dns.Msg) *dns.Msg { return new(dns.Msg).SetRcode(q, dns.RcodeServerFailure) }
+	bad, good := &fakeUpstream{reply: servfail}, new(fakeUpstream)
+	f := newTestForward(t, BreakerArgs{Failures: 2}, bad, good)
+
+	exchangeN(f, 50)
+	if n := bad.calls.Load(); n != 2 {
+		t.Fatalf("rejecting upstream should be skipped after 2 responses, got %d calls", n)
+	}
+	if s := f.us[0].breaker.getState(); s != stateOpen {
+		t.Fatalf("breaker state = %s, want open", s)
+	}
+	if st := f.us[0].status(); st.Reachable || st.Errors != 2 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestForward_breakerProbe(t *testing.T) {
+	u := new(fakeUpstream)
+	u.fail.Store(true)
+	f := newTestForward(t, BreakerArgs{Failures: 1, ProbeDomain: "probe.test"}, u)
+	b := f.us[0].breaker
+
+	exchangeN(f, 1)
+	if s := b.getState(); s != stateOpen {
+		t.Fatalf("breaker state = %s, want open", s)
+	}
+	u.fail.Store(false)
+	deadline := time.Now().Add(time.Second)
+	for b.getState() != stateClosed {
+		if time.Now().After(deadline) {
+			t.Fatal("breaker is not closed by the probe")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestForward_breakerTrial(t *testing.T) {
+	t.Run("not sent", func(t *testing.T) {
+		// bad is picked with hedging, but never queried since good
+		// answers first. Its trial must not be lost.
+		good, bad := new(fakeUpstream), new(fakeUpstream)
+		args := &Args{
+			Strategy: strategyPriority,
+			Breaker:  BreakerArgs{Failures: 1},
+			Hedge:    HedgeArgs{Delay: 1000},
+		}
+		f := newTestForwardWithArgs(t, args, good, bad)
+		b := f.us[1].breaker
+
+		b.onFailure(1)
+		time.Sleep(b.openTimeout)
+		exchangeN(f, 5)
+		if n := bad.calls.Load(); n != 0 {
+			t.Fatalf("bad upstream should not be queried, got %d calls", n)
+		}
+		if s := b.getState(); s != stateOpen {
+			t.Fatalf("breaker state = %s, want open", s)
+		}
+
+		// good fails, so the trial is sent to bad.
+		good.fail.Store(true)
+		exchangeN(f, 1)
+		if s := b.getState(); s != stateClosed {
+			t.Fatalf("breaker state = %s, want closed", s)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		u := &fakeUpstream{delay: time.Second}
+		f := newTestForward(t, BreakerArgs{Failures: 1}, u)
+		b := f.us[0].breaker
+		b.onFailure(1)
+		time.Sleep(b.openTimeout)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*20, cancel)
+		_ = f.Exec(ctx, query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+		waitInflight(t, f)
+		if s := b.getState(); s != stateOpen {
+			t.Fatalf("breaker state = %s, want open", s)
+		}
+		if !b.allow() {
+			t.Fatal("the trial should be available again")
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		b := newBreaker(BreakerArgs{Failures: 1}, &upstreamWrapper{timeout: time.Millisecond * 20})
+		b.onFailure(1)
+		b.openedAt.Store(0)
+		if !b.allow() || b.allow() {
+			t.Fatal("only one trial should be allowed")
+		}
+		time.Sleep(time.Millisecond * 20)
+		if !b.allow() {
+			t.Fatal("stale trial should be taken over")
+		}
+	})
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxInflight = 4096
+)
+
+var (
+	// errUpstreamTimeout is the cause of upstream contexts that reached
+	// the upstream's own timeout, rather than the deadline of the query.
+	errUpstreamTimeout = errors.New("upstream timeout")
+	errTooManyInflight = errors.New("too many in-flight upstream queries")
+
+	// totalInflight is the number of upstream queries of all forward
+	// plugins that are running. See Args.MaxInflight.
+	totalInflight atomic.Int64
+)
+
+// upstreamContext derives the context of a query to u from ctx. It is
+// cancelled when ctx is done, or the timeout of u is reached, whichever
+// is earlier.
+func upstreamContext(ctx context.Context, u *upstreamWrapper) (context.Context, context.CancelFunc) {
+	return context.WithTimeoutCause(ctx, u.timeout, errUpstreamTimeout)
+}
+
+// callerGaveUp reports whether ctx, which was from upstreamContext and
+// used by a query to u that was sent at start, was done because of the
+// caller (e.g. another upstream won, or the query has a short deadline).
+// Errors of such queries are not failures of the upstream.
+// A deadline of the query is a failure only if u already had its full
+// timeout, since it cannot be told apart from the upstream's own timeout.
+func callerGaveUp(ctx context.Context, u *upstreamWrapper, start time.Time) bool {
+	switch {
+	case ctx.Err() == nil, errors.Is(context.Cause(ctx), errUpstreamTimeout):
+		return false
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return time.Since(start) < u.timeout
+	default:
+		return true
+	}
+}
+
+// acquireInflight reserves a slot for an upstream query. It returns false
+// if there are already Args.MaxInflight queries of all forward plugins
+// running.
+func (f *Forward) acquireInflight() bool {
+	if totalInflight.Add(1) > int64(f.args.MaxInflight) {
+		totalInflight.Add(-1)
+		f.inflightRejected.Inc()
+		return false
+	}
+	f.inflight.Add(1)
+	return true
+}
+
+func (f *Forward) releaseInflight() {
+	f.inflight.Add(-1)
+	totalInflight.Add(-1)
+}
+
+// timeoutOf returns the query timeout of an upstream.
+func timeoutOf(c UpstreamConfig) time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout) * time.Millisecond
+	}
+	return queryTimeout
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func waitInflight(t *testing.T, f *Forward) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for f.inflight.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d upstream queries are still running", f.inflight.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForward_deadline(t *testing.T) {
+	t.Run("caller deadline", func(t *testing.T) {
+		// The query deadline is earlier than the upstream timeout. The
+		// upstream did not have its full timeout, so it is not a failure.
+		slow := &fakeUpstream{delay: time.Second}
+		f := newTestForwardWithArgs(t, &Args{Timeout: 200}, slow)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		defer cancel()
+		start := time.Now()
+		err := f.Exec(ctx, query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("want deadline exceeded, got %v", err)
+		}
+		if d := time.Since(start); d > time.Millisecond*150 {
+			t.Fatalf("exchange did not respect the deadline, took %s", d)
+		}
+		waitInflight(t, f)
+		if n := f.us[0].failures.Load(); n != 0 {
+			t.Fatalf("short query deadline should not be an upstream failure, got %d failures", n)
+		}
+		if n := testutil.ToFloat64(f.us[0].errTotal); n != 0 {
+			t.Fatalf("want no error, got %v", n)
+		}
+		if n := f.us[0].latency.Load(); n != 0 {
+			t.Fatalf("latency should not be updated, got %s", time.Duration(n))
+		}
+	})
+
+	t.Run("caller deadline after timeout", func(t *testing.T) {
+		// The query deadline is the same as the upstream timeout (e.g.
+		// the default of EntryHandler). The upstream had its full timeout,
+		// so it is a failure.
+		slow := &fakeUpstream{delay: time.Second}
+		f := newTestForwardWithArgs(t, &Args{Timeout: 20}, slow)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+		defer cancel()
+		err := f.Exec(ctx, query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+		if err == nil {
+			t.Fatal("want error")
+		}
+		waitInflight(t, f)
+		if n := f.us[0].failures.Load(); n != 1 {
+			t.Fatalf("timed out upstream should be a failure, got %d failures", n)
+		}
+		if n := testutil.ToFloat64(f.us[0].errTotal); n != 1 {
+			t.Fatalf("want 1 error, got %v", n)
+		}
+	})
+
+	t.Run("caller cancel", func(t *testing.T) {
+		slow := &fakeUpstream{delay: time.Second}
+		f := newTestForwardWithArgs(t, &Args{}, slow)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(time.Millisecond*20, cancel)
+		err := f.Exec(ctx, query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("want canceled, got %v", err)
+		}
+		waitInflight(t, f)
+		if n := f.us[0].failures.Load(); n != 0 {
+			t.Fatalf("cancelled query should not be an upstream failure, got %d failures", n)
+		}
+	})
+
+	t.Run("upstream timeout", func(t *testing.T) {
+		slow := &fakeUpstream{delay: time.Second}
+		f := newTestForwardWithArgs(t, &Args{Timeout: 20}, slow)
+		if f.us[0].timeout != time.Millisecond*20 {
+			t.Fatalf("global timeout is not applied, got %s", f.us[0].timeout)
+		}
+
+		err := f.Exec(context.Background(), query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+		if err == nil {
+			t.Fatal("want error")
+		}
+		waitInflight(t, f)
+		if n := f.us[0].failures.Load(); n != 1 {
+			t.Fatalf("upstream timeout should be a failure, got %d failures", n)
+		}
+	})
+}
+
+func TestForward_maxInflight(t *testing.T) {
+	slow, fast := &fakeUpstream{delay: time.Millisecond * 100}, new(fakeUpstream)
+	f := newTestForwardWithArgs(t, &Args{Strategy: strategyPriority, Concurrent: 2, MaxInflight: 1}, slow, fast)
+
+	err := f.Exec(context.Background(), query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fast.calls.Load(); n != 0 {
+		t.Fatalf("query over the limit should not be sent, got %d calls", n)
+	}
+	if n := testutil.ToFloat64(f.inflightRejected); n != 1 {
+		t.Fatalf("want 1 rejected query, got %v", n)
+	}
+	waitInflight(t, f)
+
+	// The limit is shared by all forward plugins.
+	other := newTestForwardWithArgs(t, &Args{MaxInflight: 1}, new(fakeUpstream))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = f.Exec(context.Background(), query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA)))
+	}()
+	for f.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := other.Exec(context.Background(), query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))); err == nil {
+		t.Fatal("query over the global limit should fail")
+	}
+	<-done
+	waitInflight(t, f)
+}
@@ -22,10 +22,13 @@ package fastforward
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand/v2"
+	"net/http"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -34,6 +37,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
@@ -49,18 +53,49 @@ func init() {
 const (
 	maxConcurrentQueries = 3
 	queryTimeout         = time.Second * 5
+
+	// An upstream is considered unreachable after this number
+	// of consecutive failed queries.
+	unreachableThreshold = 3
+
+	// Weight of the old value of the latency moving average.
+	latencyEWMAWeight = 8
 )
 
 type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// Strategy selects upstreams. Default is random.
+	//  random:      start from a random upstream.
+	//  fastest:     lowest latency first, with occasional exploration.
+	//  round_robin: weighted round-robin. See UpstreamConfig.Weight.
+	//  priority:    the order of upstreams in the config. Upstreams with
+	//               open breakers are skipped, so it is usually used with
+	//               Breaker.
+	//  hash:        consistent hashing of the qname, so caches of upstreams
+	//               stay warm.
+	Strategy string `yaml:"strategy"`
+
 	// Global options.
 	Socks5       string `yaml:"socks5"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
 	BootstrapVer int    `yaml:"bootstrap_version"`
+	Timeout      int    `yaml:"timeout"`
+
+	// MaxInflight is the maximum number of upstream queries of all forward
+	// plugins that are running at the same time, including queries that
+	// are still running after the client gave up. Queries of this plugin
+	// fail immediately if the total is over the limit. Plugins may set
+	// different limits, e.g. a lower one for less important queries.
+	// Default is 4096.
+	MaxInflight int `yaml:"max_inflight"`
+
+	Breaker BreakerArgs `yaml:"breaker"`
+	Hedge   HedgeArgs   `yaml:"hedge"`
+	Reject  RejectArgs  `yaml:"reject"`
 }
 
 type UpstreamConfig struct {
@@ -69,6 +104,15 @@ type UpstreamConfig struct {
 	DialAddr    string `yaml:"dial_addr"`
 	IdleTimeout int    `yaml:"idle_timeout"`
 
+	// Weight is used by the round_robin strategy. Default is 1.
+	Weight int `yaml:"weight"`
+
+	// Timeout is the query timeout in milliseconds. Default is 5000.
+	// The query is also cancelled if the deadline of the query context
+	// is earlier, or the query is no longer needed. Such queries are not
+	// counted as failures of the upstream.
+	Timeout int `yaml:"timeout"`
+
 	// Deprecated: This option has no affect.
 	// TODO: (v6) Remove this option.
 	MaxConns           int  `yaml:"max_conns"`
@@ -84,7 +128,7 @@ type UpstreamConfig struct {
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	f, err := NewForward(args.(*Args), Opts{Logger: bp.L(), MetricsTag: bp.Tag()})
+	f, err := NewForward(args.(*Args), Opts{Logger: bp.L(), MetricsTag: bp.Tag(), BQ: bp})
 	if err != nil {
 		return nil, err
 	}
@@ -92,23 +136,37 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		_ = f.Close()
 		return nil, err
 	}
+	bp.RegAPI(f.Api())
 	return f, nil
 }
 
 var _ sequence.Executable = (*Forward)(nil)
 var _ sequence.QuickConfigurableExec = (*Forward)(nil)
+var _ coremain.HealthReporter = (*Forward)(nil)
 
 type Forward struct {
 	args *Args
 
 	logger       *zap.Logger
 	us           []*upstreamWrapper
+	sel          *selector
+	reject       *rejectPolicy
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+
+	hedgeSent prometheus.Counter
+	hedgeWon  prometheus.Counter
+
+	inflight         atomic.Int64
+	inflightGauge    prometheus.GaugeFunc
+	inflightRejected prometheus.Counter
 }
 
 type Opts struct {
 	Logger     *zap.Logger
 	MetricsTag string
+
+	// BQ is used to find ip_sets in Args.Reject. Optional.
+	BQ sequence.BQ
 }
 
 // NewForward inits a Forward from given args.
@@ -121,11 +179,32 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		opt.Logger = zap.NewNop()
 	}
 
+	lb := map[string]string{"tag": opt.MetricsTag}
 	f := &Forward{
 		args:         args,
 		logger:       opt.Logger,
 		tag2Upstream: make(map[string]*upstreamWrapper),
+		hedgeSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hedge_sent_total",
+			Help:        "The total number of hedged queries that were sent after the delay",
+			ConstLabels: lb,
+		}),
+		hedgeWon: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "hedge_won_total",
+			Help:        "The total number of responses that were from hedged queries",
+			ConstLabels: lb,
+		}),
+		inflightRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "inflight_rejected_total",
+			Help:        "The total number of upstream queries that were not sent because of max_inflight",
+			ConstLabels: lb,
+		}),
 	}
+	f.inflightGauge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "inflight",
+		Help:        "The number of upstream queries that are currently running",
+		ConstLabels: lb,
+	}, func() float64 { return float64(f.inflight.Load()) })
 
 	applyGlobal := func(c *UpstreamConfig) {
 		utils.SetDefaultString(&c.Socks5, args.Socks5)
@@ -133,13 +212,17 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
 		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
+		utils.SetDefaultUnsignNum(&c.Timeout, args.Timeout)
 	}
+	utils.SetDefaultUnsignNum(&args.MaxInflight, defaultMaxInflight)
+	utils.SetDefaultUnsignNum(&args.Breaker.OpenTimeout, defaultOpenTimeout)
 
 	for i, c := range args.Upstreams {
 		if len(c.Addr) == 0 {
 			return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
 		}
 		applyGlobal(&c)
+		utils.SetDefaultUnsignNum(&c.Weight, 1)
 
 		uw := newWrapper(i, c, opt.MetricsTag)
 		uOpt := upstream.Opt{
@@ -166,6 +249,9 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 			return nil, fmt.Errorf("failed to init upstream #%d: %w", i, err)
 		}
 		uw.u = u
+		if args.Breaker.Failures > 0 {
+			uw.breaker = newBreaker(args.Breaker, uw)
+		}
 		f.us = append(f.us, uw)
 
 		if len(c.Tag) > 0 {
@@ -177,10 +263,35 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 	}
 
+	sel, err := newSelector(args.Strategy, f.us)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	f.sel = sel
+
+	reject, err := newRejectPolicy(args.Reject, opt.BQ)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("invalid reject args, %w", err)
+	}
+	f.reject = reject
 	return f, nil
 }
 
 func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
+	for _, c := range [...]prometheus.Collector{f.inflightGauge, f.inflightRejected} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	if f.args.Hedge.enabled() {
+		for _, c := range [...]prometheus.Collector{f.hedgeSent, f.hedgeWon} {
+			if err := r.Register(c); err != nil {
+				return err
+			}
+		}
+	}
 	for _, wu := range f.us {
 		// Only register metrics for upstream that has a tag.
 		if len(wu.cfg.Tag) == 0 {
@@ -194,7 +305,7 @@ func (f *Forward) RegisterMetricsTo(r prometheus.Registerer) error {
 }
 
 func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err error) {
-	r, err := f.exchange(ctx, qCtx, f.us)
+	r, err := f.exchange(ctx, qCtx, f.sel)
 	if err != nil {
 		return err
 	}
@@ -202,22 +313,32 @@ func (f *Forward) Exec(ctx context.Context, qCtx *query_context.Context) (err er
 	return nil
 }
 
-// QuickConfigureExec format: [upstream_tag]...
+// QuickConfigureExec format: [strategy=name] [upstream_tag]...
+// If strategy is omitted, the strategy of the plugin is used. Each
+// subset has its own states (e.g. round-robin position).
 func (f *Forward) QuickConfigureExec(args string) (any, error) {
 	var us []*upstreamWrapper
-	if len(args) == 0 { // No args, use all upstreams.
-		us = f.us
-	} else { // Pick up upstreams by tags.
-		for _, tag := range strings.Fields(args) {
-			u := f.tag2Upstream[tag]
-			if u == nil {
-				return nil, fmt.Errorf("cannot find upstream by tag %s", tag)
-			}
-			us = append(us, u)
+	strategy := f.sel.strategy
+	for _, s := range strings.Fields(args) {
+		if v, ok := parseStrategyArg(s); ok {
+			strategy = v
+			continue
+		}
+		u := f.tag2Upstream[s]
+		if u == nil {
+			return nil, fmt.Errorf("cannot find upstream by tag %s", s)
 		}
+		us = append(us, u)
+	}
+	if len(us) == 0 { // No tags, use all upstreams.
+		us = f.us
+	}
+	sel, err := newSelector(strategy, us)
+	if err != nil {
+		return nil, err
 	}
 	var execFunc sequence.ExecutableFunc = func(ctx context.Context, qCtx *query_context.Context) error {
-		r, err := f.exchange(ctx, qCtx, us)
+		r, err := f.exchange(ctx, qCtx, sel)
 		if err != nil {
 			return err
 		}
@@ -227,6 +348,35 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 	return execFunc, nil
 }
 
+// Health implements coremain.HealthReporter.
+// It returns an error if all upstreams are unreachable.
+func (f *Forward) Health() error {
+	var unreachable []string
+	for _, u := range f.us {
+		if u.reachable() {
+			return nil
+		}
+		unreachable = append(unreachable, u.name())
+	}
+	return fmt.Errorf("all upstreams are unreachable: %s", strings.Join(unreachable, ", "))
+}
+
+// Api registers:
+//
+//	GET /upstreams    status of upstreams, see UpstreamStatus.
+func (f *Forward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/upstreams", func(w http.ResponseWriter, req *http.Request) {
+		l := make([]UpstreamStatus, 0, len(f.us))
+		for _, u := range f.us {
+			l = append(l, u.status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(l)
+	})
+	return r
+}
+
 func (f *Forward) Close() error {
 	for _, u := range f.us {
 		_ = u.Close()
@@ -234,96 +384,153 @@ func (f *Forward) Close() error {
 	return nil
 }
 
-func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
-	if len(us) == 0 {
+func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, sel *selector) (*dns.Msg, error) {
+	if len(sel.us) == 0 {
 		return nil, errors.New("no upstream to exchange")
 	}
 
-	queryPayload, err := pool.PackBuffer(qCtx.Q())
-	if err != nil {
-		return nil, err
-	}
-	defer pool.ReleaseBuf(queryPayload)
-
 	concurrent := f.args.Concurrent
 	if concurrent <= 0 {
 		concurrent = 1
+		if f.args.Hedge.enabled() {
+			concurrent = 2
+		}
 	}
 	if concurrent > maxConcurrentQueries {
 		concurrent = maxConcurrentQueries
 	}
+	order := sel.order(qCtx)
+	if f.args.Hedge.enabled() {
+		return f.exchangeHedged(ctx, qCtx, pickUpstreams(order, concurrent))
+	}
+
+	queryPayload, err := pool.PackBuffer(qCtx.Q())
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(queryPayload)
 
 	type res struct {
 		r   *dns.Msg
+		v   verdict
 		err error
 	}
 
-	resChan := make(chan res)
-	done := make(chan struct{})
-	defer close(done)
+	picked := pickUpstreams(order, concurrent)
+	resChan := make(chan res, len(order)+len(picked)) // buffered, so senders never block.
 
-	r := rand.IntN(len(us))
-	for i := 0; i < concurrent; i++ {
-		u := us[(r+i)%len(us)]
+	// Queries are cancelled once this function returns, or the caller
+	// gave up.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	question := qCtx.QQuestion()
+	send := func(u *upstreamWrapper) {
+		if !f.acquireInflight() {
+			u.releaseTrial()
+			resChan <- res{err: errTooManyInflight}
+			return
+		}
 		qc := copyPayload(queryPayload)
-		go func(uqid uint32, question dns.Question) {
+		go func() {
+			defer f.releaseInflight()
 			defer pool.ReleaseBuf(qc)
-			// Give each upstream a fixed timeout to finish the query.
-			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			upstreamCtx, cancel := upstreamContext(cancelCtx, u)
 			defer cancel()
 
-			var r *dns.Msg
-			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
-			if err != nil {
+			start := time.Now()
+			r, v, err := u.exchange(upstreamCtx, *qc, f.reject.check)
+			if err != nil && !callerGaveUp(upstreamCtx, u, start) {
 				f.logger.Warn(
 					"upstream error",
-					zap.Uint32("uqid", uqid),
+					zap.Uint32("uqid", qCtx.Id()),
 					zap.String("qname", question.Name),
 					zap.Uint16("qclass", question.Qclass),
 					zap.Uint16("qtype", question.Qtype),
 					zap.String("upstream", u.name()),
 					zap.Error(err),
 				)
-			} else {
-				r = new(dns.Msg)
-				err = r.Unpack(*respPayload)
-				pool.ReleaseBuf(respPayload)
-				if err != nil {
-					r = nil
-				}
 			}
-			select {
-			case resChan <- res{r: r, err: err}:
-			case <-done:
+			resChan <- res{r: r, v: v, err: err}
+		}()
+	}
+
+	// next returns the next upstream in order that was not queried yet,
+	// or nil if there is none.
+	next := 0
+	nextUpstream := func() *upstreamWrapper {
+		for next < len(order) {
+			u := order[next]
+			next++
+			if !slices.Contains(picked, u) && u.available() {
+				picked = append(picked, u)
+				return u
 			}
-		}(qCtx.Id(), qCtx.QQuestion())
+		}
+		return nil
+	}
+
+	pending := len(picked)
+	for _, u := range picked {
+		send(u)
 	}
 
-	for i := 0; i < concurrent; i++ {
+	var fallback *dns.Msg
+	for pending > 0 {
 		select {
 		case res := <-resChan:
-			r, err := res.r, res.err
-			if err != nil {
+			pending--
+			if res.err != nil {
 				continue
 			}
 
-			// Retry until the last
-			if i < concurrent-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
-				continue
+			switch res.v {
+			case verdictAccept:
+				return res.r, nil
+			case verdictFallback:
+				fallback = res.r
+			}
+			// Rejected. Try the next upstream.
+			if u := nextUpstream(); u != nil {
+				send(u)
+				pending++
 			}
-			return r, nil
 		case <-ctx.Done():
 			return nil, context.Cause(ctx)
 		}
 	}
+	if fallback != nil {
+		return fallback, nil
+	}
 	return nil, errors.New("all upstream servers failed")
 }
 
+// pickUpstreams picks n upstreams in order, skipping upstreams whose
+// breakers are open. Like before, an upstream may be picked more than once
+// if there are not enough upstreams. If all breakers are open, upstreams
+// are picked anyway, since there is nothing better to do.
+func pickUpstreams(us []*upstreamWrapper, n int) []*upstreamWrapper {
+	avail := make([]*upstreamWrapper, 0, n)
+	for i := 0; i < len(us) && len(avail) < n; i++ {
+		if us[i].available() {
+			avail = append(avail, us[i])
+		}
+	}
+	if len(avail) == 0 {
+		avail = append(avail, us[:min(n, len(us))]...)
+	}
+	picked := avail
+	for i := len(avail); i < n; i++ {
+		picked = append(picked, avail[i%len(avail)])
+	}
+	return picked
+}
+
 func quickSetup(bq sequence.BQ, s string) (any, error) {
 	args := new(Args)
 	args.Concurrent = maxConcurrentQueries
 	for _, u := range strings.Fields(s) {
 		args.Upstreams = append(args.Upstreams, UpstreamConfig{Addr: u})
 	}
-	return NewForward(args, Opts{Logger: bq.L()})
+	return NewForward(args, Opts{Logger: bq.L(), BQ: bq})
 }
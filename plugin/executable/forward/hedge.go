@@ -0,0 +1,214 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHedgeDelay = time.Millisecond * 100
+	minHedgeDelay     = time.Millisecond
+
+	// rttSamples is the number of recent latencies kept for percentiles.
+	rttSamples = 64
+	// minRTTSamples is the number of samples needed to use percentiles.
+	minRTTSamples = 16
+)
+
+// HedgeArgs configures hedged requests. If enabled, a query is sent to the
+// first upstream, then to the next one if there is no accepted response
+// (see RejectArgs) after a delay, or the previous one failed or was
+// rejected. The first accepted response is used and other queries are
+// cancelled. Concurrent is the maximum number of upstreams to query
+// (default 2 with hedging).
+type HedgeArgs struct {
+	// Delay is the delay in milliseconds before sending the next query.
+	Delay int `yaml:"delay"`
+
+	// Percentile, if set (e.g. 95), uses the percentile of recent
+	// latencies of the upstream as the delay. Delay (or 100ms if Delay is
+	// not set) is used until there are enough samples.
+	Percentile float64 `yaml:"percentile"`
+}
+
+func (a *HedgeArgs) enabled() bool {
+	return a.Delay > 0 || a.Percentile > 0
+}
+
+// rttRecorder keeps recent latencies of an upstream.
+type rttRecorder struct {
+	mu      sync.Mutex
+	samples [rttSamples]time.Duration
+	n       int // number of samples, up to rttSamples.
+	next    int
+}
+
+func (rr *rttRecorder) add(d time.Duration) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	rr.samples[rr.next] = d
+	rr.next = (rr.next + 1) % rttSamples
+	rr.n = min(rr.n+1, rttSamples)
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of the samples.
+// It returns false if there are not enough samples.
+func (rr *rttRecorder) percentile(p float64) (time.Duration, bool) {
+	rr.mu.Lock()
+	if rr.n < minRTTSamples {
+		rr.mu.Unlock()
+		return 0, false
+	}
+	s := slices.Clone(rr.samples[:rr.n])
+	rr.mu.Unlock()
+
+	slices.Sort(s)
+	i := int(float64(len(s))*p/100+0.5) - 1
+	return s[max(0, min(i, len(s)-1))], true
+}
+
+func (f *Forward) hedgeDelay(u *upstreamWrapper) time.Duration {
+	h := f.args.Hedge
+	if h.Percentile > 0 {
+		if d, ok := u.rtt.percentile(h.Percentile); ok {
+			return min(max(d, minHedgeDelay), u.timeout)
+		}
+	}
+	if h.Delay > 0 {
+		return time.Duration(h.Delay) * time.Millisecond
+	}
+	return defaultHedgeDelay
+}
+
+// exchangeHedged exchanges the query with hedged requests.
+// See HedgeArgs.
+func (f *Forward) exchangeHedged(ctx context.Context, qCtx *query_context.Context, us []*upstreamWrapper) (*dns.Msg, error) {
+	queryPayload, err := pool.PackBuffer(qCtx.Q())
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(queryPayload)
+
+	type res struct {
+		r      *dns.Msg
+		v      verdict
+		err    error
+		hedged bool
+	}
+	resChan := make(chan res, len(us)) // buffered, so senders never block.
+
+	// Queries are cancelled once this function returns.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	question := qCtx.QQuestion()
+	send := func(u *upstreamWrapper, hedged bool) {
+		if !f.acquireInflight() {
+			u.releaseTrial()
+			resChan <- res{err: errTooManyInflight, hedged: hedged}
+			return
+		}
+		qc := copyPayload(queryPayload)
+		go func() {
+			defer f.releaseInflight()
+			defer pool.ReleaseBuf(qc)
+			upstreamCtx, cancel := upstreamContext(cancelCtx, u)
+			defer cancel()
+
+			start := time.Now()
+			r, v, err := u.exchange(upstreamCtx, *qc, f.reject.check)
+			if err != nil && !callerGaveUp(upstreamCtx, u, start) {
+				f.logger.Warn(
+					"upstream error",
+					zap.Uint32("uqid", qCtx.Id()),
+					zap.String("qname", question.Name),
+					zap.Uint16("qclass", question.Qclass),
+					zap.Uint16("qtype", question.Qtype),
+					zap.String("upstream", u.name()),
+					zap.Error(err),
+				)
+			}
+			resChan <- res{r: r, v: v, err: err, hedged: hedged}
+		}()
+	}
+
+	timer := time.NewTimer(f.hedgeDelay(us[0]))
+	defer timer.Stop()
+	send(us[0], false)
+	sent, pending := 1, 1
+	defer func() {
+		// Give up the breaker trials of upstreams that were not queried.
+		for _, u := range us[sent:] {
+			if !slices.Contains(us[:sent], u) {
+				u.releaseTrial()
+			}
+		}
+	}()
+	sendNext := func(hedged bool) {
+		if sent >= len(us) {
+			return
+		}
+		if hedged {
+			f.hedgeSent.Inc()
+		}
+		send(us[sent], hedged)
+		timer.Reset(f.hedgeDelay(us[sent]))
+		sent++
+		pending++
+	}
+
+	var fallback *dns.Msg
+	for pending > 0 {
+		select {
+		case res := <-resChan:
+			pending--
+			if res.err == nil {
+				switch res.v {
+				case verdictAccept:
+					if res.hedged {
+						f.hedgeWon.Inc()
+					}
+					return res.r, nil
+				case verdictFallback:
+					fallback = res.r
+				}
+			}
+			sendNext(false) // Failed or rejected. No need to wait.
+		case <-timer.C:
+			sendNext(true)
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, errors.New("all upstream servers failed")
+}
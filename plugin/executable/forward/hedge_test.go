@@ -0,0 +1,84 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestForward_hedge(t *testing.T) {
+	slow := &fakeUpstream{delay: time.Second}
+	fast := new(fakeUpstream)
+	f := newTestForwardWithArgs(t, &Args{Strategy: strategyPriority, Hedge: HedgeArgs{Delay: 20}}, slow, fast)
+
+	start := time.Now()
+	if err := f.Exec(context.Background(), newTestQCtx("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Fatalf("hedged query should win, took %s", d)
+	}
+	if sent, won := testutil.ToFloat64(f.hedgeSent), testutil.ToFloat64(f.hedgeWon); sent != 1 || won != 1 {
+		t.Fatalf("hedge sent %v, won %v, want 1, 1", sent, won)
+	}
+	time.Sleep(time.Millisecond * 20) // wait for the cancelled query.
+	if n := f.us[0].failures.Load(); n != 0 {
+		t.Fatalf("cancelled query should not be a failure, got %d failures", n)
+	}
+
+	// The next upstream is queried at once if the first one failed.
+	bad := new(fakeUpstream)
+	bad.fail.Store(true)
+	f = newTestForwardWithArgs(t, &Args{Strategy: strategyPriority, Hedge: HedgeArgs{Delay: 1000}}, bad, fast)
+	start = time.Now()
+	if err := f.Exec(context.Background(), newTestQCtx("example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Fatalf("failed query should not wait for the delay, took %s", d)
+	}
+	if sent := testutil.ToFloat64(f.hedgeSent); sent != 0 {
+		t.Fatalf("hedge sent = %v, want 0", sent)
+	}
+}
+
+func Test_rttRecorder_percentile(t *testing.T) {
+	var rr rttRecorder
+	for i := 1; i < minRTTSamples; i++ {
+		rr.add(time.Duration(i) * time.Millisecond)
+	}
+	if _, ok := rr.percentile(95); ok {
+		t.Fatal("should not have enough samples")
+	}
+	for i := minRTTSamples; i <= 100; i++ {
+		rr.add(time.Duration(i) * time.Millisecond)
+	}
+	// The last 64 samples are 37ms to 100ms.
+	if d, _ := rr.percentile(50); d != 68*time.Millisecond {
+		t.Errorf("p50 = %s", d)
+	}
+	if d, _ := rr.percentile(100); d != 100*time.Millisecond {
+		t.Errorf("p100 = %s", d)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// RejectArgs configures which responses are rejected. If a response is
+// rejected, forward queries the next upstream that was not queried yet,
+// and waits for its response.
+// If all responses are rejected, the last response that was not rejected
+// by IPs is used.
+// Rejected responses are failures of their upstreams, like errors.
+type RejectArgs struct {
+	// Rcodes are the rejected rcodes, by names (e.g. SERVFAIL) or numbers.
+	// Default is all rcodes other than NOERROR and NXDOMAIN.
+	Rcodes []string `yaml:"rcodes"`
+
+	// EmptyAnswer rejects NOERROR responses that have no answer.
+	EmptyAnswer bool `yaml:"empty_answer"`
+
+	// Truncated rejects truncated responses.
+	Truncated bool `yaml:"truncated"`
+
+	// Responses that have A/AAAA answers in IPs, IPSets or Files are
+	// rejected and never used, since they are usually poisoned.
+	IPs    []string `yaml:"ips"`
+	IPSets []string `yaml:"ip_sets"`
+	Files  []string `yaml:"files"`
+}
+
+type verdict int
+
+const (
+	verdictAccept   verdict = iota
+	verdictFallback         // rejected, but can be used if there is nothing better.
+	verdictDrop             // rejected and never used.
+)
+
+// rejectPolicy checks responses from upstreams. See RejectArgs.
+type rejectPolicy struct {
+	rcodes      map[int]struct{} // nil means the default.
+	emptyAnswer bool
+	truncated   bool
+	ips         netlist.Matcher // nil if not configured.
+}
+
+func newRejectPolicy(args RejectArgs, bq sequence.BQ) (*rejectPolicy, error) {
+	p := &rejectPolicy{emptyAnswer: args.EmptyAnswer, truncated: args.Truncated}
+
+	if len(args.Rcodes) > 0 {
+		p.rcodes = make(map[int]struct{})
+		for _, s := range args.Rcodes {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+			if !ok {
+				n, err := strconv.ParseUint(s, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid rcode %s", s)
+				}
+				rcode = int(n)
+			}
+			p.rcodes[rcode] = struct{}{}
+		}
+	}
+
+	var mg ip_set.MatcherGroup
+	for _, tag := range args.IPSets {
+		if bq == nil {
+			return nil, errors.New("ip_sets are not available")
+		}
+		provider, _ := bq.M().GetPlugin(tag).(data_provider.IPMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find ipset %s", tag)
+		}
+		mg = append(mg, provider.GetIPMatcher())
+	}
+	if len(args.IPs)+len(args.Files) > 0 {
+		l := netlist.NewList()
+		if err := ip_set.LoadFromIPsAndFiles(args.IPs, args.Files, l); err != nil {
+			return nil, fmt.Errorf("failed to load ips, %w", err)
+		}
+		l.Sort()
+		mg = append(mg, l)
+	}
+	if len(mg) > 0 {
+		p.ips = mg
+	}
+	return p, nil
+}
+
+func (p *rejectPolicy) check(r *dns.Msg) verdict {
+	if p.ips != nil && hasAddrIn(r, p.ips) {
+		return verdictDrop
+	}
+	if p.rcodes != nil {
+		if _, ok := p.rcodes[r.Rcode]; ok {
+			return verdictFallback
+		}
+	} else if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return verdictFallback
+	}
+	if p.emptyAnswer && r.Rcode == dns.RcodeSuccess && len(r.Answer) == 0 {
+		return verdictFallback
+	}
+	if p.truncated && r.Truncated {
+		return verdictFallback
+	}
+	return verdictAccept
+}
+
+// hasAddrIn reports whether r has an A/AAAA answer in m.
+func hasAddrIn(r *dns.Msg, m netlist.Matcher) bool {
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if ok && m.Match(addr) {
+			return true
+		}
+	}
+	return false
+}
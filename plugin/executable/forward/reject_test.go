@@ -0,0 +1,159 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func replyA(ip string) func(q *dns.Msg) *dns.Msg {
+	return func(q *dns.Msg) *dns.Msg {
+		r := new(dns.Msg).SetReply(q)
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		})
+		return r
+	}
+}
+
+func Test_rejectPolicy_check(t *testing.T) {
+	msg := func(rcode int, ip string, truncated bool) *dns.Msg {
+		q := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+		r := new(dns.Msg).SetRcode(q, rcode)
+		if len(ip) > 0 {
+			r = replyA(ip)(q)
+		}
+		r.Truncated = truncated
+		return r
+	}
+
+	tests := []struct {
+		name string
+		args RejectArgs
+		r    *dns.Msg
+		want verdict
+	}{
+		{"default noerror", RejectArgs{}, msg(dns.RcodeSuccess, "", false), verdictAccept},
+		{"default nxdomain", RejectArgs{}, msg(dns.RcodeNameError, "", false), verdictAccept},
+		{"default servfail", RejectArgs{}, msg(dns.RcodeServerFailure, "", false), verdictFallback},
+		{"rcodes", RejectArgs{Rcodes: []string{"refused", "3"}}, msg(dns.RcodeNameError, "", false), verdictFallback},
+		{"rcodes not listed", RejectArgs{Rcodes: []string{"REFUSED"}}, msg(dns.RcodeServerFailure, "", false), verdictAccept},
+		{"empty answer", RejectArgs{EmptyAnswer: true}, msg(dns.RcodeSuccess, "", false), verdictFallback},
+		{"has answer", RejectArgs{EmptyAnswer: true}, msg(dns.RcodeSuccess, "1.1.1.1", false), verdictAccept},
+		{"truncated", RejectArgs{Truncated: true}, msg(dns.RcodeSuccess, "1.1.1.1", true), verdictFallback},
+		{"bogus ip", RejectArgs{IPs: []string{"10.0.0.0/8"}}, msg(dns.RcodeSuccess, "10.1.1.1", false), verdictDrop},
+		{"good ip", RejectArgs{IPs: []string{"10.0.0.0/8"}}, msg(dns.RcodeSuccess, "1.1.1.1", false), verdictAccept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newRejectPolicy(tt.args, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := p.check(tt.r); got != tt.want {
+				t.Errorf("check() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newRejectPolicy(RejectArgs{Rcodes: []string{"bad"}}, nil); err == nil {
+		t.Error("invalid rcode should be an error")
+	}
+}
+
+func TestForward_reject(t *testing.T) {
+	exchange := func(f *Forward) (*dns.Msg, error) {
+		qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if err := f.Exec(context.Background(), qCtx); err != nil {
+			return nil, err
+		}
+		return qCtx.R(), nil
+	}
+	poisoned := func() *fakeUpstream { return &fakeUpstream{reply: replyA("10.1.1.1")} }
+	reject := RejectArgs{IPs: []string{"10.0.0.0/8"}}
+
+	for _, concurrent := range []int{0, 1} {
+		t.Run(fmt.Sprintf("concurrent %d", concurrent), func(t *testing.T) {
+			bad, good := poisoned(), &fakeUpstream{reply: replyA("1.1.1.1")}
+			args := &Args{Strategy: strategyPriority, Concurrent: concurrent, Reject: reject}
+			f := newTestForwardWithArgs(t, args, bad, good)
+			r, err := exchange(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip := r.Answer[0].(*dns.A).A.String(); ip != "1.1.1.1" {
+				t.Fatalf("got poisoned answer %s", ip)
+			}
+			if bad.calls.Load() != 1 || good.calls.Load() != 1 {
+				t.Fatal("rejected response should trigger the next upstream")
+			}
+		})
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		good := &fakeUpstream{reply: replyA("1.1.1.1")}
+		f := newTestForwardWithArgs(t, &Args{Concurrent: 2, Reject: reject}, poisoned(), good)
+		for i := 0; i < 10; i++ {
+			r, err := exchange(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip := r.Answer[0].(*dns.A).A.String(); ip != "1.1.1.1" {
+				t.Fatalf("got poisoned answer %s", ip)
+			}
+		}
+	})
+
+	t.Run("hedge", func(t *testing.T) {
+		good := &fakeUpstream{reply: replyA("1.1.1.1")}
+		args := &Args{Strategy: strategyPriority, Hedge: HedgeArgs{Delay: 1000}, Reject: reject}
+		f := newTestForwardWithArgs(t, args, poisoned(), good)
+		r, err := exchange(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip := r.Answer[0].(*dns.A).A.String(); ip != "1.1.1.1" {
+			t.Fatalf("got poisoned answer %s", ip)
+		}
+		if good.calls.Load() != 1 {
+			t.Fatal("rejected response should trigger the next upstream")
+		}
+	})
+
+	t.Run("all poisoned", func(t *testing.T) {
+		us := []*fakeUpstream{poisoned(), poisoned(), poisoned()}
+		f := newTestForwardWithArgs(t, &Args{Concurrent: 2, Reject: reject}, us...)
+		if _, err := exchange(f); err == nil {
+			t.Fatal("poisoned responses should never be used")
+		}
+		for i, u := range us {
+			if n := u.calls.Load(); n != 1 {
+				t.Fatalf("upstream #%d got %d calls, want 1", i, n)
+			}
+		}
+	})
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+)
+
+// Upstream selection strategies.
+const (
+	strategyRandom     = "random"      // start from a random upstream.
+	strategyFastest    = "fastest"     // lowest moving average latency first.
+	strategyRoundRobin = "round_robin" // smooth weighted round-robin.
+	strategyPriority   = "priority"    // the order of the config.
+	strategyHash       = "hash"        // consistent hashing of the qname.
+)
+
+// fastestExploreRate is the rate that the fastest strategy picks upstreams
+// randomly, so latencies of other upstreams are updated.
+const fastestExploreRate = 0.05
+
+// selector orders upstreams by a strategy.
+type selector struct {
+	strategy string
+	us       []*upstreamWrapper
+
+	// round_robin states.
+	mu      sync.Mutex
+	current []int
+}
+
+func newSelector(strategy string, us []*upstreamWrapper) (*selector, error) {
+	switch strategy {
+	case "":
+		strategy = strategyRandom
+	case strategyRandom, strategyFastest, strategyRoundRobin, strategyPriority, strategyHash:
+	default:
+		return nil, fmt.Errorf("invalid strategy %s", strategy)
+	}
+	s := &selector{strategy: strategy, us: us}
+	if strategy == strategyRoundRobin {
+		s.current = make([]int, len(us))
+	}
+	return s, nil
+}
+
+// order returns all upstreams, the preferred first.
+func (s *selector) order(qCtx *query_context.Context) []*upstreamWrapper {
+	switch s.strategy {
+	case strategyFastest:
+		if rand.Float64() < fastestExploreRate {
+			return s.rotate(rand.IntN(len(s.us)))
+		}
+		l := slices.Clone(s.us)
+		// Upstreams that have no latency yet go first.
+		slices.SortStableFunc(l, func(a, b *upstreamWrapper) int {
+			return cmp.Compare(a.latency.Load(), b.latency.Load())
+		})
+		return l
+	case strategyRoundRobin:
+		return s.rotate(s.nextWeighted())
+	case strategyPriority:
+		return s.us
+	case strategyHash:
+		return s.rendezvous(domain.NormalizeDomain(qCtx.QQuestion().Name))
+	default:
+		return s.rotate(rand.IntN(len(s.us)))
+	}
+}
+
+func (s *selector) rotate(start int) []*upstreamWrapper {
+	l := make([]*upstreamWrapper, 0, len(s.us))
+	l = append(l, s.us[start:]...)
+	return append(l, s.us[:start]...)
+}
+
+// nextWeighted returns the index of the next upstream by the smooth
+// weighted round-robin algorithm.
+func (s *selector) nextWeighted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total, best := 0, 0
+	for i, u := range s.us {
+		w := u.cfg.Weight
+		s.current[i] += w
+		total += w
+		if s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// rendezvous orders upstreams by their highest random weights of the key.
+// When an upstream is added or removed, only keys on it are moved.
+func (s *selector) rendezvous(key string) []*upstreamWrapper {
+	type scored struct {
+		u     *upstreamWrapper
+		score uint64
+	}
+	l := make([]scored, 0, len(s.us))
+	for _, u := range s.us {
+		h := fnv.New64a()
+		h.Write([]byte(u.cfg.Addr))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		l = append(l, scored{u: u, score: h.Sum64()})
+	}
+	slices.SortFunc(l, func(a, b scored) int { return cmp.Compare(b.score, a.score) })
+	us := make([]*upstreamWrapper, 0, len(l))
+	for _, e := range l {
+		us = append(us, e.u)
+	}
+	return us
+}
+
+// parseStrategyArg parses a "strategy=name" quick setup arg.
+func parseStrategyArg(s string) (string, bool) {
+	return strings.CutPrefix(s, "strategy=")
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func newTestWrappers(weights ...int) []*upstreamWrapper {
+	var us []*upstreamWrapper
+	for i, w := range weights {
+		us = append(us, newWrapper(i, UpstreamConfig{Addr: fmt.Sprintf("127.0.0.%d", i+1), Weight: w}, ""))
+	}
+	return us
+}
+
+func newTestQCtx(name string) *query_context.Context {
+	return query_context.NewContext(new(dns.Msg).SetQuestion(name, dns.TypeA))
+}
+
+func TestSelector(t *testing.T) {
+	qCtx := newTestQCtx("example.com.")
+
+	t.Run("priority", func(t *testing.T) {
+		us := newTestWrappers(1, 1, 1)
+		s, _ := newSelector(strategyPriority, us)
+		if got := s.order(qCtx); got[0] != us[0] || got[2] != us[2] {
+			t.Fatal("priority should keep the config order")
+		}
+	})
+
+	t.Run("round_robin", func(t *testing.T) {
+		us := newTestWrappers(3, 1)
+		s, _ := newSelector(strategyRoundRobin, us)
+		counts := make(map[*upstreamWrapper]int)
+		for i := 0; i < 40; i++ {
+			counts[s.order(qCtx)[0]]++
+		}
+		if counts[us[0]] != 30 || counts[us[1]] != 10 {
+			t.Fatalf("unexpected distribution %d:%d", counts[us[0]], counts[us[1]])
+		}
+	})
+
+	t.Run("fastest", func(t *testing.T) {
+		us := newTestWrappers(1, 1, 1)
+		us[0].observeLatency(time.Millisecond * 30)
+		us[1].observeLatency(time.Millisecond * 10)
+		us[2].observeLatency(time.Millisecond * 20)
+		s, _ := newSelector(strategyFastest, us)
+		fastest := 0
+		for i := 0; i < 100; i++ {
+			if s.order(qCtx)[0] == us[1] {
+				fastest++
+			}
+		}
+		if fastest < 80 {
+			t.Fatalf("fastest upstream was picked first %d/100 times", fastest)
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		us := newTestWrappers(1, 1, 1)
+		s, _ := newSelector(strategyHash, us)
+		seen := make(map[*upstreamWrapper]bool)
+		for i := 0; i < 30; i++ {
+			c := newTestQCtx(fmt.Sprintf("d%d.example.com.", i))
+			first := s.order(c)[0]
+			if s.order(c)[0] != first {
+				t.Fatal("hash should be stable")
+			}
+			seen[first] = true
+		}
+		if len(seen) != 3 {
+			t.Fatalf("names should be spread to all upstreams, got %d", len(seen))
+		}
+
+		// Removing an upstream only moves names on it.
+		s2, _ := newSelector(strategyHash, us[:2])
+		for i := 0; i < 30; i++ {
+			c := newTestQCtx(fmt.Sprintf("d%d.example.com.", i))
+			if first := s.order(c)[0]; first != us[2] && s2.order(c)[0] != first {
+				t.Fatal("name is moved")
+			}
+		}
+	})
+
+	if _, err := newSelector("unknown", newTestWrappers(1)); err == nil {
+		t.Fatal("invalid strategy should be rejected")
+	}
+}
@@ -21,6 +21,7 @@ package fastforward
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
@@ -34,6 +35,8 @@ type upstreamWrapper struct {
 	idx             int
 	u               upstream.Upstream
 	cfg             UpstreamConfig
+	pluginTag       string
+	timeout         time.Duration
 	queryTotal      prometheus.Counter
 	errTotal        prometheus.Counter
 	thread          prometheus.Gauge
@@ -41,6 +44,15 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+
+	// number of consecutive failed queries, reset by a successful query.
+	failures atomic.Int64
+	queries  atomic.Uint64
+	errs     atomic.Uint64
+	latency  atomic.Int64 // moving average in nanoseconds.
+	rtt      rttRecorder
+
+	breaker *breaker // nil if the breaker is disabled.
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -57,7 +69,10 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
 	return &upstreamWrapper{
-		cfg: cfg,
+		idx:       idx,
+		cfg:       cfg,
+		pluginTag: pluginTag,
+		timeout:   timeoutOf(cfg),
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
 			Help:        "The total number of queries processed by this upstream",
@@ -94,14 +109,30 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 }
 
 func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{
+	collectors := []prometheus.Collector{
 		uw.queryTotal,
 		uw.errTotal,
 		uw.thread,
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
-	} {
+	}
+	if b := uw.breaker; b != nil {
+		lb := map[string]string{"upstream": uw.cfg.Tag, "tag": uw.pluginTag}
+		collectors = append(collectors,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "breaker_state",
+				Help:        "The state of the circuit breaker. 0: closed, 1: open, 2: half-open",
+				ConstLabels: lb,
+			}, func() float64 { return float64(b.getState()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "breaker_trips_total",
+				Help:        "The total number of times that the circuit breaker was opened",
+				ConstLabels: lb,
+			}, func() float64 { return float64(b.trips.Load()) }),
+		)
+	}
+	for _, collector := range collectors {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -118,26 +149,136 @@ func (uw *upstreamWrapper) name() string {
 	return uw.cfg.Addr
 }
 
-func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+// exchange sends m to the upstream, then unpacks the response and checks
+// it with check. Errors and responses that are not accepted by check are
+// failures of the upstream.
+func (uw *upstreamWrapper) exchange(ctx context.Context, m []byte, check func(r *dns.Msg) verdict) (*dns.Msg, verdict, error) {
 	uw.queryTotal.Inc()
+	uw.queries.Add(1)
 
 	start := time.Now()
 	uw.thread.Inc()
-	r, err := uw.u.ExchangeContext(ctx, m)
+	respPayload, err := uw.u.ExchangeContext(ctx, m)
 	uw.thread.Dec()
 
-	if err != nil {
+	if err != nil && callerGaveUp(ctx, uw, start) {
+		// Cancelled by the caller (e.g. another hedged query won).
+		// It is not a failure of the upstream.
+		uw.releaseTrial()
+		return nil, verdictDrop, err
+	}
+
+	var r *dns.Msg
+	v := verdictDrop
+	if err == nil {
+		r = new(dns.Msg)
+		err = r.Unpack(*respPayload)
+		pool.ReleaseBuf(respPayload)
+		if err != nil {
+			r = nil
+		} else {
+			v = check(r)
+		}
+	}
+
+	if err != nil || v != verdictAccept {
 		uw.errTotal.Inc()
+		uw.errs.Add(1)
+		uw.observeLatency(uw.timeout)
+		n := uw.failures.Add(1)
+		if uw.breaker != nil {
+			uw.breaker.onFailure(n)
+		}
 	} else {
-		uw.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
+		d := time.Since(start)
+		uw.responseLatency.Observe(float64(d.Milliseconds()))
+		uw.observeLatency(d)
+		uw.rtt.add(d)
+		uw.failures.Store(0)
+		if uw.breaker != nil {
+			uw.breaker.onSuccess()
+		}
+	}
+	return r, v, err
+}
+
+// observeLatency updates the moving average of latency.
+// Concurrent updates may be lost, which is fine for an estimate.
+func (uw *upstreamWrapper) observeLatency(d time.Duration) {
+	old := uw.latency.Load()
+	if old == 0 {
+		uw.latency.Store(int64(d))
+		return
+	}
+	uw.latency.Store(old + (int64(d)-old)/latencyEWMAWeight)
+}
+
+// available reports whether a query can be sent to this upstream.
+// It is always true if the breaker is disabled.
+// Note: If the breaker is half-open, available takes the trial. If the
+// query is not sent, releaseTrial must be called.
+func (uw *upstreamWrapper) available() bool {
+	return uw.breaker == nil || uw.breaker.allow()
+}
+
+// releaseTrial gives up the half-open trial that was taken by available.
+// It is a noop if the breaker is not half-open.
+func (uw *upstreamWrapper) releaseTrial() {
+	if uw.breaker != nil {
+		uw.breaker.releaseTrial()
 	}
-	return r, err
+}
+
+// reachable returns false if the last unreachableThreshold queries
+// to this upstream all failed or its breaker is open.
+func (uw *upstreamWrapper) reachable() bool {
+	if uw.breaker != nil && uw.breaker.getState() == stateOpen {
+		return false
+	}
+	return uw.failures.Load() < unreachableThreshold
 }
 
 func (uw *upstreamWrapper) Close() error {
+	if uw.breaker != nil {
+		uw.breaker.close()
+	}
 	return uw.u.Close()
 }
 
+// UpstreamStatus is the status of an upstream.
+type UpstreamStatus struct {
+	Name                string  `json:"name"`
+	Addr                string  `json:"addr"`
+	Reachable           bool    `json:"reachable"`
+	ConsecutiveFailures int64   `json:"consecutive_failures"`
+	Queries             uint64  `json:"queries"`
+	Errors              uint64  `json:"errors"`
+	LatencyMs           float64 `json:"latency_ms"` // moving average, failed queries count as timeouts.
+	Breaker             string  `json:"breaker,omitempty"`
+	BreakerTrips        uint64  `json:"breaker_trips,omitempty"`
+	BreakerOpenedAt     string  `json:"breaker_opened_at,omitempty"`
+}
+
+func (uw *upstreamWrapper) status() UpstreamStatus {
+	s := UpstreamStatus{
+		Name:                uw.name(),
+		Addr:                uw.cfg.Addr,
+		Reachable:           uw.reachable(),
+		ConsecutiveFailures: uw.failures.Load(),
+		Queries:             uw.queries.Load(),
+		Errors:              uw.errs.Load(),
+		LatencyMs:           float64(uw.latency.Load()) / float64(time.Millisecond),
+	}
+	if b := uw.breaker; b != nil {
+		s.Breaker = b.getState().String()
+		s.BreakerTrips = b.trips.Load()
+		if st := b.getState(); st != stateClosed {
+			s.BreakerOpenedAt = time.Unix(0, b.openedAt.Load()).Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
 type queryInfo dns.Msg
 
 func (q *queryInfo) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
@@ -20,7 +20,9 @@
 package ipset
 
 import (
+	"context"
 	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	"strconv"
 	"strings"
@@ -40,10 +42,11 @@ type Args struct {
 }
 
 var _ sequence.Executable = (*ipSetPlugin)(nil)
+var _ sequence.SideEffectReporter = (*ipSetPlugin)(nil)
 
 // QuickSetup format: [set_name,{inet|inet6},mask] *2
 // e.g. "my_set,inet,24 my_set6,inet6,48"
-func QuickSetup(_ sequence.BQ, s string) (any, error) {
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
 	fs := strings.Fields(s)
 	if len(fs) > 2 {
 		return nil, fmt.Errorf("expect no more than 2 fields, got %d", len(fs))
@@ -71,5 +74,13 @@ func QuickSetup(_ sequence.BQ, s string) (any, error) {
 			return nil, fmt.Errorf("invalid set family, %s", ss[0])
 		}
 	}
+	if bq != nil && bq.M().DryRun() { // Don't open the netlink socket.
+		return sequence.ExecutableFunc(func(context.Context, *query_context.Context) error { return nil }), nil
+	}
 	return newIpSetPlugin(args)
 }
+
+// HasSideEffects implements sequence.SideEffectReporter.
+func (p *ipSetPlugin) HasSideEffects() bool {
+	return true
+}
@@ -56,7 +56,7 @@ func newIpSetPlugin(args *Args) (*ipSetPlugin, error) {
 
 func (p *ipSetPlugin) Exec(_ context.Context, qCtx *query_context.Context) error {
 	r := qCtx.R()
-	if r != nil {
+	if r != nil && !qCtx.DryRun() {
 		if err := p.addIPSet(r); err != nil {
 			return fmt.Errorf("ipset: %w", err)
 		}
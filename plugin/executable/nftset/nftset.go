@@ -33,6 +33,7 @@ func init() {
 }
 
 var _ sequence.Executable = (*nftSetPlugin)(nil)
+var _ sequence.SideEffectReporter = (*nftSetPlugin)(nil)
 
 type Args struct {
 	IPv4 SetArgs `yaml:"ipv4"`
@@ -82,3 +83,8 @@ func QuickSetup(_ sequence.BQ, s string) (any, error) {
 	}
 	return newNftSetPlugin(args)
 }
+
+// HasSideEffects implements sequence.SideEffectReporter.
+func (p *nftSetPlugin) HasSideEffects() bool {
+	return true
+}
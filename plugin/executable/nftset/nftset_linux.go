@@ -82,7 +82,7 @@ func newNftSetPlugin(args *Args) (*nftSetPlugin, error) {
 
 func (p *nftSetPlugin) Exec(_ context.Context, qCtx *query_context.Context) error {
 	r := qCtx.R()
-	if r != nil {
+	if r != nil && !qCtx.DryRun() {
 		if err := p.addElems(r); err != nil {
 			return fmt.Errorf("nftable: %w", err)
 		}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "retry"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+const (
+	defaultAttempts = 3
+	defaultBackoff  = 100 // ms
+	maxBackoff      = time.Second * 5
+
+	onError    = "error"
+	onServfail = "servfail"
+	onEmpty    = "empty"
+)
+
+type Args struct {
+	// Exec is the tag of the executable.
+	Exec string `yaml:"exec"`
+
+	// Attempts is the maximum number of runs, including the first one.
+	// Default is 3.
+	Attempts int `yaml:"attempts"`
+
+	// Backoff is the wait time in milliseconds before the first retry.
+	// It is doubled after each retry, up to 5s. Default is 100.
+	// Use a negative value to retry without waiting.
+	Backoff int `yaml:"backoff"`
+
+	// On is the conditions to retry. Default is error and servfail.
+	//  error:    the executable returned an error.
+	//  servfail: the response is SERVFAIL.
+	//  empty:    there is no response or the response is NOERROR without
+	//            answers. Note that NODATA responses (e.g. AAAA of IPv4
+	//            only names) are also empty, which are usually valid.
+	On []string `yaml:"on"`
+}
+
+var _ sequence.Executable = (*Retry)(nil)
+
+// Retry runs an executable again if it failed.
+type Retry struct {
+	tag      string
+	e        sequence.Executable
+	attempts int
+	backoff  time.Duration
+	logger   *zap.Logger
+
+	onError, onServfail, onEmpty bool
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRetry(bp, args.(*Args))
+}
+
+func NewRetry(bq sequence.BQ, args *Args) (*Retry, error) {
+	tag := strings.TrimPrefix(args.Exec, "$")
+	if len(tag) == 0 {
+		return nil, errors.New("missing exec tag")
+	}
+	e := sequence.ToExecutable(bq.M().GetPlugin(tag))
+	if e == nil {
+		return nil, fmt.Errorf("can not find executable %s", tag)
+	}
+	utils.SetDefaultUnsignNum(&args.Attempts, defaultAttempts)
+	utils.SetDefaultNum(&args.Backoff, defaultBackoff)
+	if len(args.On) == 0 {
+		args.On = []string{onError, onServfail}
+	}
+
+	r := &Retry{
+		tag:      tag,
+		e:        e,
+		attempts: args.Attempts,
+		backoff:  time.Duration(max(args.Backoff, 0)) * time.Millisecond,
+		logger:   bq.L(),
+	}
+	for _, s := range args.On {
+		switch s {
+		case onError:
+			r.onError = true
+		case onServfail:
+			r.onServfail = true
+		case onEmpty:
+			r.onEmpty = true
+		default:
+			return nil, fmt.Errorf("invalid retry condition %s", s)
+		}
+	}
+	return r, nil
+}
+
+func (r *Retry) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	backoff := r.backoff
+	for i := 1; ; i++ {
+		if i > 1 {
+			// Responses of previous attempts must not be judged again.
+			qCtx.SetResponse(nil)
+		}
+		err := r.e.Exec(ctx, qCtx)
+		if i >= r.attempts || !r.shouldRetry(err, qCtx.R()) {
+			return err
+		}
+		r.logger.Debug("retrying", zap.String("exec", r.tag), zap.Int("attempt", i), qCtx.InfoField(), zap.Error(err))
+
+		if backoff > 0 {
+			timer := pool.GetTimer(backoff)
+			select {
+			case <-timer.C:
+				pool.ReleaseTimer(timer)
+			case <-ctx.Done():
+				pool.ReleaseTimer(timer)
+				if err != nil {
+					return err
+				}
+				return context.Cause(ctx)
+			}
+			backoff = min(backoff*2, maxBackoff)
+		}
+	}
+}
+
+func (r *Retry) shouldRetry(err error, resp *dns.Msg) bool {
+	switch {
+	case err != nil:
+		return r.onError
+	case resp != nil && resp.Rcode == dns.RcodeServerFailure:
+		return r.onServfail
+	case resp == nil || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0):
+		return r.onEmpty
+	default:
+		return false
+	}
+}
+
+// QuickSetup format: exec_tag [attempts [backoff_ms]]
+// e.g. "forward_remote 3 100"
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 || len(fs) > 3 {
+		return nil, fmt.Errorf("expect 1 to 3 fields, got %d", len(fs))
+	}
+	args := &Args{Exec: fs[0]}
+	if len(fs) > 1 {
+		n, err := strconv.Atoi(fs[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid attempts, %w", err)
+		}
+		args.Attempts = n
+	}
+	if len(fs) > 2 {
+		n, err := strconv.Atoi(fs[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid backoff, %w", err)
+		}
+		args.Backoff = n
+	}
+	return NewRetry(bq, args)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+// flaky fails with results in order, then succeeds.
+type flaky struct {
+	results []string // "error", "servfail", "nxdomain", "empty" or "none" (no response)
+	runs    int
+}
+
+func (f *flaky) Exec(_ context.Context, qCtx *query_context.Context) error {
+	f.runs++
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	if f.runs <= len(f.results) {
+		switch f.results[f.runs-1] {
+		case "error":
+			return errors.New("error")
+		case "servfail":
+			r.Rcode = dns.RcodeServerFailure
+		case "nxdomain":
+			r.Rcode = dns.RcodeNameError
+		case "none":
+			return nil
+		}
+		qCtx.SetResponse(r)
+		return nil
+	}
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(1, 1, 1, 1)})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func TestRetry_Exec(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  []string
+		args     Args
+		wantRuns int
+		wantErr  bool
+	}{
+		{"success", nil, Args{}, 1, false},
+		{"retry all", []string{"error", "servfail", "empty"}, Args{Attempts: 4, On: []string{"error", "servfail", "empty"}}, 4, false},
+		{"empty not default", []string{"empty"}, Args{}, 1, false},
+		{"nxdomain not empty", []string{"nxdomain"}, Args{On: []string{"empty"}}, 1, false},
+		{"attempts exhausted", []string{"error", "error", "error"}, Args{}, 3, true},
+		{"condition not enabled", []string{"servfail"}, Args{On: []string{"error"}}, 1, false},
+		{"stale response", []string{"servfail", "none"}, Args{On: []string{"servfail"}}, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &flaky{results: tt.results}
+			m := coremain.NewTestMosdnsWithPlugins(map[string]any{"f": f})
+			tt.args.Exec = "f"
+			tt.args.Backoff = -1
+			r, err := NewRetry(coremain.NewBP("test", m), &tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			if err := r.Exec(context.Background(), qCtx); (err != nil) != tt.wantErr {
+				t.Errorf("Exec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if f.runs != tt.wantRuns {
+				t.Errorf("runs = %d, want %d", f.runs, tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestRetry_keepResponse(t *testing.T) {
+	// f sets no response. The response from earlier rules is kept.
+	f := &flaky{results: []string{"none"}}
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"f": f})
+	r, err := NewRetry(coremain.NewBP("test", m), &Args{Exec: "f", Backoff: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	resp := new(dns.Msg).SetReply(qCtx.Q())
+	qCtx.SetResponse(resp)
+	if err := r.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() != resp {
+		t.Fatal("response set before retry was cleared")
+	}
+}
@@ -96,6 +96,9 @@ func setupJump(bq BQ, s string) (any, error) {
 	if target == nil {
 		return nil, fmt.Errorf("can not find jump target %s", s)
 	}
+	if len(target.finally) > 0 {
+		return nil, fmt.Errorf("can not jump to %s, it has finally rules", s)
+	}
 	return &ActionJump{To: target.chain}, nil
 }
 
@@ -115,6 +118,9 @@ func setupGoto(bq BQ, s string) (any, error) {
 	if gt == nil {
 		return nil, fmt.Errorf("can not find goto target %s", s)
 	}
+	if len(gt.finally) > 0 {
+		return nil, fmt.Errorf("can not goto %s, it has finally rules", s)
+	}
 	return &ActionGoto{To: gt.chain}, nil
 }
 
@@ -25,21 +25,66 @@ import (
 	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"io"
+	"sync"
+	"time"
 )
 
 type ChainNode struct {
 	Matches []Matcher // Can be empty, indicates this node has no match specified.
 
-	// At least one of E or RE must not nil.
+	// At least one of E, RE or skipTo must be set.
 	// In case both are set. E is preferred.
 	E  Executable
 	RE RecursiveExecutable
+
+	// skipTo, if > 0, is the index of the node that the walker continues at.
+	// It is used by blocks to skip their branches.
+	skipTo int
+
+	info  *ruleInfo  // nil if this node is not a rule.
+	stats *ruleStats // nil if stats are not enabled.
 }
 
 type ChainWalker struct {
 	p        int
 	chain    []*ChainNode
 	jumpBack *ChainWalker
+
+	// nextObserver, if not nil, records the time and errors of ExecNext,
+	// so they are not counted in the stats of the recursive executable
+	// that called it.
+	nextObserver *nextObserver
+}
+
+// nextObserver records the following rules that a recursive executable
+// ran by ChainWalker.ExecNext. Only those that finished before done are
+// recorded, because ExecNext may be called in the background (e.g. lazy
+// cache update).
+type nextObserver struct {
+	mu   sync.Mutex
+	done bool
+	d    time.Duration
+	err  error // the last error
+}
+
+func (o *nextObserver) observe(d time.Duration, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.done {
+		return
+	}
+	o.d += d
+	if err != nil {
+		o.err = err
+	}
+}
+
+// finish stops recording and returns what was recorded.
+func (o *nextObserver) finish() (time.Duration, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.done = true
+	return o.d, o.err
 }
 
 func NewChainWalker(chain []*ChainNode, jumpBack *ChainWalker) ChainWalker {
@@ -50,6 +95,21 @@ func NewChainWalker(chain []*ChainNode, jumpBack *ChainWalker) ChainWalker {
 }
 
 func (w *ChainWalker) ExecNext(ctx context.Context, qCtx *query_context.Context) error {
+	if o := w.nextObserver; o != nil {
+		nw := *w
+		nw.nextObserver = nil
+		start := time.Now()
+		err := nw.ExecNext(ctx, qCtx)
+		o.observe(time.Since(start), err)
+		return err
+	}
+
+	if activeTraces.Load() > 0 {
+		if t := traceFromContext(ctx); t != nil {
+			return w.execNextTrace(ctx, qCtx, t)
+		}
+	}
+
 	p := w.p
 	// Evaluate rules' matchers in loop.
 checkMatchesLoop:
@@ -59,6 +119,9 @@ checkMatchesLoop:
 		for _, match := range n.Matches {
 			ok, err := match.Match(ctx, qCtx)
 			if err != nil {
+				if n.stats != nil {
+					n.stats.errs.Add(1)
+				}
 				return err
 			}
 			if !ok {
@@ -67,11 +130,22 @@ checkMatchesLoop:
 				continue checkMatchesLoop
 			}
 		}
+		if n.stats != nil {
+			n.stats.matched.Add(1)
+		}
 
 		// Exec rules' executables in loop, or in stack if it is a recursive executable.
 		switch {
 		case n.E != nil:
-			if err := n.E.Exec(ctx, qCtx); err != nil {
+			var start time.Time
+			if n.stats != nil {
+				start = time.Now()
+			}
+			err := n.E.Exec(ctx, qCtx)
+			if n.stats != nil {
+				n.stats.observeExec(start, err)
+			}
+			if err != nil {
 				return err
 			}
 			p++
@@ -82,7 +156,18 @@ checkMatchesLoop:
 				chain:    w.chain,
 				jumpBack: w.jumpBack,
 			}
+			if n.stats != nil {
+				o := new(nextObserver)
+				next.nextObserver = o
+				start := time.Now()
+				err := n.RE.Exec(ctx, qCtx, next)
+				n.stats.observeRecursiveExec(start, err, o)
+				return err
+			}
 			return n.RE.Exec(ctx, qCtx, next)
+		case n.skipTo > 0:
+			p = n.skipTo
+			continue
 		default:
 			panic("n cannot be executed")
 		}
@@ -100,25 +185,113 @@ func (w *ChainWalker) nop() bool {
 	return w.p >= len(w.chain)
 }
 
-func (s *Sequence) buildChain(bq BQ, rs []RuleConfig) error {
-	c := make([]*ChainNode, 0, len(rs))
-	for ri, r := range rs {
-		n, err := s.newNode(bq, r, ri)
+func (s *Sequence) buildChain(bq BQ, rs, finally []RuleConfig) error {
+	c, err := s.appendRules(bq, make([]*ChainNode, 0, len(rs)), rs, "r")
+	if err != nil {
+		return err
+	}
+	s.chain = c
+	if len(finally) > 0 {
+		f, err := s.appendRules(bq, nil, finally, "f")
 		if err != nil {
-			return fmt.Errorf("failed to init rule #%d, %w", ri, err)
+			return fmt.Errorf("failed to init finally, %w", err)
 		}
-		c = append(c, n)
+		// Recursive executables can not stop the finally rules.
+		for _, n := range f {
+			if n.E == nil && n.RE != nil {
+				n.E = noNextExec{re: n.RE}
+			}
+		}
+		s.finally = f
 	}
-	s.chain = c
 	return nil
 }
 
-func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
+// noNextExec runs a RecursiveExecutable with a nop next. So the walker
+// always continues with the following nodes.
+type noNextExec struct {
+	re RecursiveExecutable
+}
+
+func (e noNextExec) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	return e.re.Exec(ctx, qCtx, ChainWalker{})
+}
+
+// appendRules appends nodes of rs to c. Blocks are flattened, so
+// the walker executes them without recursion.
+// prefix is the prefix of anonymous plugins' logger names.
+func (s *Sequence) appendRules(bq BQ, c []*ChainNode, rs []RuleConfig, prefix string) ([]*ChainNode, error) {
+	for ri, r := range rs {
+		name := fmt.Sprintf("%s%d", prefix, ri)
+		info := newRuleInfo(s.tag, name, r)
+		var st *ruleStats
+		if s.statsEnabled {
+			st = &ruleStats{info: info}
+			s.stats = append(s.stats, st)
+		}
+		var err error
+		if r.isBlock() {
+			c, err = s.appendBlock(bq, c, r, name, info, st)
+		} else {
+			var n *ChainNode
+			n, err = s.newNode(bq, r, name)
+			if n != nil {
+				n.info = info
+				n.stats = st
+			}
+			c = append(c, n)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to init rule #%d, %w", ri, err)
+		}
+	}
+	return c, nil
+}
+
+// appendBlock appends the block r to c as:
+//
+//	cond:  matches !(if), skip to else
+//	       then rules...
+//	       skip to end (if there is an else)
+//	else:  else rules...
+//	end:
+func (s *Sequence) appendBlock(bq BQ, c []*ChainNode, r RuleConfig, name string, info *ruleInfo, st *ruleStats) ([]*ChainNode, error) {
+	cond, err := s.newMatcher(bq, MatchConfig{All: r.If}, name+".if")
+	if err != nil {
+		return nil, fmt.Errorf("failed to init if, %w", err)
+	}
+	if st != nil {
+		cond = statsMatch{m: cond, st: st}
+	}
+	condNode := &ChainNode{Matches: []Matcher{reverseMatcher(cond)}, info: info}
+	c = append(c, condNode)
+
+	c, err = s.appendRules(bq, c, r.Then, name+".then.r")
+	if err != nil {
+		return nil, fmt.Errorf("failed to init then, %w", err)
+	}
+	if len(r.Else) == 0 {
+		condNode.skipTo = len(c)
+		return c, nil
+	}
+
+	endNode := new(ChainNode)
+	c = append(c, endNode)
+	condNode.skipTo = len(c)
+	c, err = s.appendRules(bq, c, r.Else, name+".else.r")
+	if err != nil {
+		return nil, fmt.Errorf("failed to init else, %w", err)
+	}
+	endNode.skipTo = len(c)
+	return c, nil
+}
+
+func (s *Sequence) newNode(bq BQ, r RuleConfig, name string) (*ChainNode, error) {
 	n := new(ChainNode)
 
 	// init matches
 	for mi, mc := range r.Matches {
-		m, err := s.newMatcher(bq, mc, ri, mi)
+		m, err := s.newMatcher(bq, mc, fmt.Sprintf("%s.m%d", name, mi))
 		if err != nil {
 			return nil, fmt.Errorf("failed to init matcher #%d, %w", mi, err)
 		}
@@ -126,7 +299,7 @@ func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
 	}
 
 	// init exec
-	e, re, err := s.newExec(bq, r, ri)
+	e, re, err := s.newExec(bq, r, name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init exec, %w", err)
 	}
@@ -135,9 +308,28 @@ func (s *Sequence) newNode(bq BQ, r RuleConfig, ri int) (*ChainNode, error) {
 	return n, nil
 }
 
-func (s *Sequence) newMatcher(bq BQ, mc MatchConfig, ri, mi int) (Matcher, error) {
+func (s *Sequence) newMatcher(bq BQ, mc MatchConfig, name string) (Matcher, error) {
 	var m Matcher
 	switch {
+	case len(mc.Any) > 0 || len(mc.All) > 0:
+		group := mc.All
+		if len(mc.Any) > 0 {
+			group = mc.Any
+		}
+		ms := make([]Matcher, 0, len(group))
+		for i, c := range group {
+			sm, err := s.newMatcher(bq, c, fmt.Sprintf("%s.m%d", name, i))
+			if err != nil {
+				return nil, fmt.Errorf("failed to init matcher #%d, %w", i, err)
+			}
+			ms = append(ms, sm)
+		}
+		if len(mc.Any) > 0 {
+			m = anyMatch(ms)
+		} else {
+			m = allMatch(ms)
+		}
+
 	case len(mc.Tag) > 0:
 		m, _ = bq.M().GetPlugin(mc.Tag).(Matcher)
 		if m == nil {
@@ -156,7 +348,7 @@ func (s *Sequence) newMatcher(bq BQ, mc MatchConfig, ri, mi int) (Matcher, error
 		if f == nil {
 			return nil, fmt.Errorf("invalid matcher type %s", mc.Type)
 		}
-		p, err := f(NewBQ(bq.M(), bq.L().Named(fmt.Sprintf("r%d.m%d", ri, mi))), mc.Args)
+		p, err := f(NewBQ(bq.M(), bq.L().Named(name)), mc.Args)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init matcher, %w", err)
 		}
@@ -172,7 +364,7 @@ func (s *Sequence) newMatcher(bq BQ, mc MatchConfig, ri, mi int) (Matcher, error
 	return m, nil
 }
 
-func (s *Sequence) newExec(bq BQ, rc RuleConfig, ri int) (Executable, RecursiveExecutable, error) {
+func (s *Sequence) newExec(bq BQ, rc RuleConfig, name string) (Executable, RecursiveExecutable, error) {
 	var exec any
 	switch {
 	case len(rc.Tag) > 0:
@@ -195,7 +387,7 @@ func (s *Sequence) newExec(bq BQ, rc RuleConfig, ri int) (Executable, RecursiveE
 		if f == nil {
 			return nil, nil, fmt.Errorf("invalid executable type %s", rc.Type)
 		}
-		v, err := f(NewBQ(bq.M(), bq.L().Named(fmt.Sprintf("r%d", ri))), rc.Args)
+		v, err := f(NewBQ(bq.M(), bq.L().Named(name)), rc.Args)
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to init executable, %w", err)
 		}
@@ -235,3 +427,29 @@ func (r reverseMatch) Match(ctx context.Context, qCtx *query_context.Context) (b
 	}
 	return !ok, nil
 }
+
+// anyMatch is matched if one of its matchers is matched.
+type anyMatch []Matcher
+
+func (a anyMatch) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	for _, m := range a {
+		ok, err := m.Match(ctx, qCtx)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// allMatch is matched if all of its matchers are matched.
+type allMatch []Matcher
+
+func (a allMatch) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	for _, m := range a {
+		ok, err := m.Match(ctx, qCtx)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -19,23 +19,118 @@
 
 package sequence
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 type RuleArgs struct {
 	Matches []string `yaml:"matches"`
 	Exec    string   `yaml:"exec"`
+
+	// If, Then and Else make this rule a block. Rules in Then are
+	// executed if all matchers in If are matched. Otherwise, rules in
+	// Else are executed.
+	// An element in If is a matcher string (same as Matches) or a match
+	// group, which is a map with one "any" or "all" key and a list of
+	// elements. "any" is matched if one of its elements is matched,
+	// "all" is matched if all of its elements are matched.
+	If   []any      `yaml:"if"`
+	Then []RuleArgs `yaml:"then"`
+	Else []RuleArgs `yaml:"else"`
 }
 
-func parseArgs(ra RuleArgs) RuleConfig {
+func parseArgs(ra RuleArgs) (RuleConfig, error) {
 	var rc RuleConfig
 	for _, s := range ra.Matches {
 		rc.Matches = append(rc.Matches, parseMatch(s))
 	}
+
+	if len(ra.If) > 0 || len(ra.Then) > 0 || len(ra.Else) > 0 {
+		switch {
+		case len(ra.If) == 0:
+			return rc, errors.New("block has no if")
+		case len(ra.Then) == 0:
+			return rc, errors.New("block has no then")
+		case len(ra.Matches) > 0 || len(ra.Exec) > 0:
+			return rc, errors.New("block can not have matches or exec, use if and then instead")
+		}
+		for i, v := range ra.If {
+			mc, err := parseMatchArgs(v)
+			if err != nil {
+				return rc, fmt.Errorf("invalid if #%d, %w", i, err)
+			}
+			rc.If = append(rc.If, mc)
+		}
+		for i, r := range ra.Then {
+			c, err := parseArgs(r)
+			if err != nil {
+				return rc, fmt.Errorf("invalid then rule #%d, %w", i, err)
+			}
+			rc.Then = append(rc.Then, c)
+		}
+		for i, r := range ra.Else {
+			c, err := parseArgs(r)
+			if err != nil {
+				return rc, fmt.Errorf("invalid else rule #%d, %w", i, err)
+			}
+			rc.Else = append(rc.Else, c)
+		}
+		return rc, nil
+	}
+
 	tag, typ, args := parseExec(ra.Exec)
 	rc.Tag = tag
 	rc.Type = typ
 	rc.Args = args
-	return rc
+	return rc, nil
+}
+
+// parseMatchArgs parses an element of RuleArgs.If.
+func parseMatchArgs(v any) (MatchConfig, error) {
+	var m map[string]any
+	switch v := v.(type) {
+	case string:
+		return parseMatch(v), nil
+	case map[string]any:
+		m = v
+	case map[any]any:
+		m = make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = e
+		}
+	default:
+		return MatchConfig{}, fmt.Errorf("invalid match type %T", v)
+	}
+
+	if len(m) != 1 {
+		return MatchConfig{}, errors.New("match group must have exactly one any or all key")
+	}
+	var mc MatchConfig
+	for k, e := range m {
+		l, ok := e.([]any)
+		if !ok || len(l) == 0 {
+			return mc, fmt.Errorf("match group %s must be a non-empty list", k)
+		}
+		var group []MatchConfig
+		for i, v := range l {
+			c, err := parseMatchArgs(v)
+			if err != nil {
+				return mc, fmt.Errorf("invalid %s #%d, %w", k, i, err)
+			}
+			group = append(group, c)
+		}
+		switch k {
+		case "any":
+			mc.Any = group
+		case "all":
+			mc.All = group
+		default:
+			return mc, fmt.Errorf("invalid match group %s", k)
+		}
+	}
+	return mc, nil
 }
 
 func parseMatch(s string) MatchConfig {
@@ -72,6 +167,14 @@ type RuleConfig struct {
 	Tag     string        `yaml:"tag"`
 	Type    string        `yaml:"type"`
 	Args    string        `yaml:"args"`
+
+	If   []MatchConfig `yaml:"if"`
+	Then []RuleConfig  `yaml:"then"`
+	Else []RuleConfig  `yaml:"else"`
+}
+
+func (rc *RuleConfig) isBlock() bool {
+	return len(rc.If) > 0
 }
 
 type MatchConfig struct {
@@ -79,6 +182,10 @@ type MatchConfig struct {
 	Type    string `yaml:"type"`
 	Args    string `yaml:"args"`
 	Reverse bool   `yaml:"reverse"`
+
+	// Match groups. At most one of them is set.
+	Any []MatchConfig `yaml:"any"`
+	All []MatchConfig `yaml:"all"`
 }
 
 func trimPrefixField(s, p string) (string, bool) {
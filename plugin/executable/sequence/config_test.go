@@ -79,3 +79,26 @@ func Test_parseMatch(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseArgs_block(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    RuleArgs
+		wantErr bool
+	}{
+		{"block", RuleArgs{If: []any{"$m", map[string]any{"any": []any{"$m", "!$m"}}}, Then: []RuleArgs{{Exec: "$e"}}}, false},
+		{"no then", RuleArgs{If: []any{"$m"}}, true},
+		{"no if", RuleArgs{Then: []RuleArgs{{Exec: "$e"}}}, true},
+		{"block with exec", RuleArgs{If: []any{"$m"}, Then: []RuleArgs{{Exec: "$e"}}, Exec: "$e"}, true},
+		{"invalid group", RuleArgs{If: []any{map[string]any{"none": []any{"$m"}}}, Then: []RuleArgs{{Exec: "$e"}}}, true},
+		{"empty group", RuleArgs{If: []any{map[string]any{"all": []any{}}}, Then: []RuleArgs{{Exec: "$e"}}}, true},
+		{"invalid nested rule", RuleArgs{If: []any{"$m"}, Then: []RuleArgs{{If: []any{"$m"}}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseArgs(tt.args); (err != nil) != tt.wantErr {
+				t.Errorf("parseArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -56,3 +56,10 @@ type MatchFunc func(ctx context.Context, qCtx *query_context.Context) (bool, err
 func (f MatchFunc) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
 	return f(ctx, qCtx)
 }
+
+// SideEffectReporter can be implemented by executables that have side
+// effects out of the query, e.g. adding IPs to system sets. If it reports
+// true, the executable is skipped in dry-run traces. See Trace.
+type SideEffectReporter interface {
+	HasSideEffects() bool
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "parallel"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	policyFirst       = "first"
+	policyFirstAnswer = "first_answer"
+	policyIPSet       = "ip_set"
+	policyMajority    = "majority"
+)
+
+type Args struct {
+	// Exec is the tags of executables (usually sequences) that run in parallel.
+	Exec []string `yaml:"exec"`
+
+	// Policy selects the response. Default is "first".
+	//  first:        the first response.
+	//  first_answer: the first response that has answers.
+	//  ip_set:       the first response that has A/AAAA answers, and all
+	//                of their IPs are in IPs/IPSets/Files.
+	//  majority:     the response that more than half of executables agree.
+	// If no response is accepted by the policy, ErrNotAccepted is returned.
+	Policy string `yaml:"policy"`
+
+	// Fallback uses the first response if no response is accepted by the
+	// policy, instead of returning ErrNotAccepted.
+	Fallback bool `yaml:"fallback"`
+
+	// For "ip_set" policy.
+	IPs    []string `yaml:"ips"`
+	IPSets []string `yaml:"ip_sets"`
+	Files  []string `yaml:"files"`
+}
+
+var (
+	ErrNoResponse  = errors.New("no response from all executables")
+	ErrNotAccepted = errors.New("no response is accepted by the policy")
+)
+
+var _ sequence.Executable = (*parallel)(nil)
+
+type parallel struct {
+	logger    *zap.Logger
+	tags      []string
+	execs     []sequence.Executable
+	policy    string
+	fallback  bool
+	ipMatcher *base_ip.Matcher
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return newParallel(bp, args.(*Args))
+}
+
+func newParallel(bp *coremain.BP, args *Args) (*parallel, error) {
+	if len(args.Exec) < 2 {
+		return nil, errors.New("parallel requires at least two executables")
+	}
+	p := &parallel{
+		logger:   bp.L(),
+		tags:     args.Exec,
+		policy:   args.Policy,
+		fallback: args.Fallback,
+	}
+	for _, tag := range args.Exec {
+		e := sequence.ToExecutable(bp.M().GetPlugin(tag))
+		if e == nil {
+			return nil, fmt.Errorf("can not find executable %s", tag)
+		}
+		p.execs = append(p.execs, e)
+	}
+
+	switch p.policy {
+	case "":
+		p.policy = policyFirst
+	case policyFirst, policyFirstAnswer, policyMajority:
+	case policyIPSet:
+		ipArgs := &base_ip.Args{IPs: args.IPs, IPSets: args.IPSets, Files: args.Files}
+		if len(ipArgs.IPs)+len(ipArgs.IPSets)+len(ipArgs.Files) == 0 {
+			return nil, errors.New("ip_set policy requires ips, ip_sets or files")
+		}
+		m, err := base_ip.NewMatcher(bp, ipArgs, allRespAddrIn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init ip matcher, %w", err)
+		}
+		p.ipMatcher = m
+	default:
+		return nil, fmt.Errorf("invalid policy %s", p.policy)
+	}
+	return p, nil
+}
+
+type result struct {
+	i    int
+	qCtx *query_context.Context
+	err  error
+}
+
+// Exec runs all executables on copies of qCtx. The response and marks of
+// the selected copy replace those of qCtx, and its values are merged back
+// to qCtx (values deleted by the executable are kept). Executables that
+// are still running will be cancelled.
+func (p *parallel) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(p.execs))
+	for i, e := range p.execs {
+		bqCtx := qCtx.Copy()
+		go func() {
+			err := e.Exec(ctx, bqCtx)
+			results <- result{i: i, qCtx: bqCtx, err: err}
+		}()
+	}
+
+	var first *query_context.Context // first response, used by fallback.
+	votes := make(map[string]int)
+	for range p.execs {
+		var res result
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case res = <-results:
+		}
+
+		if res.err != nil {
+			p.logger.Debug("executable error", zap.String("exec", p.tags[res.i]), qCtx.InfoField(), zap.Error(res.err))
+			continue
+		}
+		r := res.qCtx.R()
+		if r == nil {
+			continue
+		}
+		if first == nil {
+			first = res.qCtx
+		}
+
+		accepted, err := p.accept(ctx, res.qCtx, votes)
+		if err != nil {
+			return err
+		}
+		if accepted {
+			p.selectResult(qCtx, res.qCtx)
+			return nil
+		}
+	}
+
+	switch {
+	case first == nil:
+		return ErrNoResponse
+	case !p.fallback:
+		return ErrNotAccepted
+	}
+	p.selectResult(qCtx, first)
+	return nil
+}
+
+func (p *parallel) accept(ctx context.Context, bqCtx *query_context.Context, votes map[string]int) (bool, error) {
+	r := bqCtx.R()
+	switch p.policy {
+	case policyFirstAnswer:
+		return r.Rcode == dns.RcodeSuccess && len(r.Answer) > 0, nil
+	case policyIPSet:
+		return p.ipMatcher.Match(ctx, bqCtx)
+	case policyMajority:
+		k := answerKey(r)
+		votes[k]++
+		return votes[k] > len(p.execs)/2, nil
+	default:
+		return true, nil
+	}
+}
+
+func (p *parallel) selectResult(qCtx, bqCtx *query_context.Context) {
+	qCtx.SetResponse(bqCtx.R())
+	// bqCtx was copied from qCtx, so marks that it doesn't have were
+	// deleted by the executable.
+	for _, m := range qCtx.Marks() {
+		if !bqCtx.HasMark(m) {
+			qCtx.DeleteMark(m)
+		}
+	}
+	qCtx.MergeFrom(bqCtx)
+}
+
+// allRespAddrIn reports whether the response has A/AAAA answers and
+// all of them are in m.
+func allRespAddrIn(qCtx *query_context.Context, m netlist.Matcher) (bool, error) {
+	r := qCtx.R()
+	if r == nil {
+		return false, nil
+	}
+	n := 0
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok || !m.Match(addr.Unmap()) {
+			return false, nil
+		}
+		n++
+	}
+	return n > 0, nil
+}
+
+// answerKey returns a key of r's rcode and answers. Responses with
+// the same answers in different orders or ttls have the same key.
+func answerKey(r *dns.Msg) string {
+	rrs := make([]string, 0, len(r.Answer))
+	for _, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		rrs = append(rrs, rr.String())
+	}
+	slices.Sort(rrs)
+	return fmt.Sprintf("%d\n%s", r.Rcode, strings.Join(rrs, "\n"))
+}
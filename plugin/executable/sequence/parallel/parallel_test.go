@@ -0,0 +1,191 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package parallel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+type dummy struct {
+	delay time.Duration
+	ip    string // empty: no answer
+	err   error
+	mark  uint32
+	unset uint32 // mark to delete
+
+	cancelled chan struct{}
+}
+
+func (d *dummy) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	select {
+	case <-time.After(d.delay):
+	case <-ctx.Done():
+		if d.cancelled != nil {
+			close(d.cancelled)
+		}
+		return ctx.Err()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	if len(d.ip) > 0 {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(d.delay / time.Millisecond)},
+			A:   net.ParseIP(d.ip),
+		})
+	}
+	qCtx.SetResponse(r)
+	qCtx.SetMark(d.mark)
+	qCtx.DeleteMark(d.unset)
+	return nil
+}
+
+func Test_parallel_Exec(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name     string
+		execs    []*dummy
+		args     Args
+		wantErr  bool
+		wantMark uint32
+	}{
+		{
+			name:     "first",
+			execs:    []*dummy{{delay: 50 * ms, ip: "1.1.1.1", mark: 1}, {delay: 10 * ms, mark: 2}},
+			wantMark: 2,
+		},
+		{
+			name:     "first skips errors",
+			execs:    []*dummy{{delay: 50 * ms, ip: "1.1.1.1", mark: 1}, {delay: 10 * ms, err: errors.New("err"), mark: 2}},
+			wantMark: 1,
+		},
+		{
+			name:    "all failed",
+			execs:   []*dummy{{err: errors.New("err")}, {err: errors.New("err")}},
+			wantErr: true,
+		},
+		{
+			name:     "first_answer",
+			execs:    []*dummy{{delay: 50 * ms, ip: "1.1.1.1", mark: 1}, {delay: 10 * ms, mark: 2}},
+			args:     Args{Policy: policyFirstAnswer},
+			wantMark: 1,
+		},
+		{
+			name:     "ip_set",
+			execs:    []*dummy{{delay: 50 * ms, ip: "1.1.1.1", mark: 1}, {delay: 10 * ms, ip: "2.2.2.2", mark: 2}},
+			args:     Args{Policy: policyIPSet, IPs: []string{"1.0.0.0/8"}},
+			wantMark: 1,
+		},
+		{
+			name:    "ip_set not accepted",
+			execs:   []*dummy{{delay: 50 * ms, ip: "3.3.3.3", mark: 1}, {delay: 10 * ms, ip: "2.2.2.2", mark: 2}},
+			args:    Args{Policy: policyIPSet, IPs: []string{"1.0.0.0/8"}},
+			wantErr: true,
+		},
+		{
+			name:     "ip_set fallback",
+			execs:    []*dummy{{delay: 50 * ms, ip: "3.3.3.3", mark: 1}, {delay: 10 * ms, ip: "2.2.2.2", mark: 2}},
+			args:     Args{Policy: policyIPSet, IPs: []string{"1.0.0.0/8"}, Fallback: true},
+			wantMark: 2,
+		},
+		{
+			name: "majority",
+			execs: []*dummy{
+				{delay: 10 * ms, ip: "2.2.2.2", mark: 1},
+				{delay: 20 * ms, ip: "1.1.1.1", mark: 2},
+				{delay: 30 * ms, ip: "1.1.1.1", mark: 3},
+			},
+			args:     Args{Policy: policyMajority},
+			wantMark: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := make(map[string]any)
+			for i, d := range tt.execs {
+				tag := string(rune('a' + i))
+				ps[tag] = d
+				tt.args.Exec = append(tt.args.Exec, tag)
+			}
+			p, err := newParallel(coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(ps)), &tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+			err = p.Exec(context.Background(), qCtx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !qCtx.HasMark(tt.wantMark) {
+				t.Errorf("Exec() did not select the response of mark %d", tt.wantMark)
+			}
+			if qCtx.R() == nil {
+				t.Error("Exec() did not set the response")
+			}
+		})
+	}
+}
+
+func Test_parallel_cancel(t *testing.T) {
+	slow := &dummy{delay: time.Second, cancelled: make(chan struct{})}
+	ps := map[string]any{"fast": &dummy{}, "slow": slow}
+	p, err := newParallel(coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(ps)), &Args{Exec: []string{"fast", "slow"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err := p.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-slow.cancelled:
+	case <-time.After(time.Millisecond * 500):
+		t.Fatal("losing executable was not cancelled")
+	}
+}
+
+func Test_parallel_unsetMark(t *testing.T) {
+	ps := map[string]any{"a": &dummy{mark: 1, unset: 9}, "b": &dummy{delay: time.Second}}
+	p, err := newParallel(coremain.NewBP("test", coremain.NewTestMosdnsWithPlugins(ps)), &Args{Exec: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	qCtx.SetMark(9)
+	if err := p.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if !qCtx.HasMark(1) || qCtx.HasMark(9) {
+		t.Fatalf("unexpected marks %v", qCtx.Marks())
+	}
+}
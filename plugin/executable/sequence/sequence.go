@@ -21,14 +21,21 @@ package sequence
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"net/http"
 )
 
 const PluginType = "sequence"
 
 func init() {
-	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(any) })
 
 	MustRegExecQuickSetup("accept", setupAccept)
 	MustRegExecQuickSetup("reject", setupReject)
@@ -40,8 +47,14 @@ func init() {
 }
 
 type Sequence struct {
+	tag              string
 	chain            []*ChainNode
+	finally          []*ChainNode
 	anonymousPlugins []any
+	logger           *zap.Logger
+
+	statsEnabled bool
+	stats        []*ruleStats // in the order of the config.
 }
 
 func (s *Sequence) Close() error {
@@ -53,25 +66,154 @@ func (s *Sequence) Close() error {
 
 type Args = []RuleArgs
 
+// ObjectArgs is the object form of Args. The sequence args can be a rule
+// list (Args) or an ObjectArgs.
+type ObjectArgs struct {
+	Rules []RuleArgs `yaml:"rules"`
+
+	// Finally rules run after Rules, no matter how Rules ended
+	// (e.g. accept, reject, goto or an error). They see the final
+	// response. They can not use control flow executables (accept,
+	// reject, return, goto, jump). Other recursive executables (e.g. cache)
+	// can not stop them either, the next rule always runs. Their errors
+	// are logged but not returned.
+	// A sequence that has finally rules can not be the target of jump or
+	// goto, since its rules would run without them.
+	Finally []RuleArgs `yaml:"finally"`
+
+	// Stats enables per-rule counters. They are exposed by metrics
+	// and the "/stats" api.
+	Stats bool `yaml:"stats"`
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
-	return NewSequence(bp, *args.(*Args))
+	oa, err := parseInitArgs(*args.(*any))
+	if err != nil {
+		return nil, fmt.Errorf("invalid args, %w", err)
+	}
+	s, err := newSequence(bp, bp.Tag(), oa)
+	if err != nil {
+		return nil, err
+	}
+	if oa.Stats {
+		r := prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())
+		if err := s.regMetricsTo(r, bp.Tag()); err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("failed to register metrics, %w", err)
+		}
+	}
+	bp.RegAPI(s.Api())
+	return s, nil
+}
+
+func parseInitArgs(v any) (*ObjectArgs, error) {
+	switch v := v.(type) {
+	case *ObjectArgs:
+		return v, nil
+	case *Args:
+		return &ObjectArgs{Rules: *v}, nil
+	case Args:
+		return &ObjectArgs{Rules: v}, nil
+	case map[string]any, map[any]any:
+		oa := new(ObjectArgs)
+		if err := utils.WeakDecode(v, oa); err != nil {
+			return nil, err
+		}
+		return oa, nil
+	default:
+		var ra Args
+		if err := utils.WeakDecode(v, &ra); err != nil {
+			return nil, err
+		}
+		return &ObjectArgs{Rules: ra}, nil
+	}
 }
 
 func NewSequence(bq BQ, ra []RuleArgs) (*Sequence, error) {
-	s := &Sequence{}
+	return newSequence(bq, "", &ObjectArgs{Rules: ra})
+}
+
+func newSequence(bq BQ, tag string, args *ObjectArgs) (*Sequence, error) {
+	s := &Sequence{tag: tag, logger: bq.L(), statsEnabled: args.Stats}
 
-	var rc []RuleConfig
-	for _, ra := range ra {
-		rc = append(rc, parseArgs(ra))
+	parse := func(ra []RuleArgs) ([]RuleConfig, error) {
+		var rc []RuleConfig
+		for i, ra := range ra {
+			c, err := parseArgs(ra)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule #%d, %w", i, err)
+			}
+			rc = append(rc, c)
+		}
+		return rc, nil
 	}
-	if err := s.buildChain(bq, rc); err != nil {
+	rc, err := parse(args.Rules)
+	if err != nil {
+		return nil, err
+	}
+	frc, err := parse(args.Finally)
+	if err != nil {
+		return nil, fmt.Errorf("invalid finally, %w", err)
+	}
+	if err := checkNoControlFlow(frc); err != nil {
+		return nil, fmt.Errorf("invalid finally, %w", err)
+	}
+
+	if err := s.buildChain(bq, rc, frc); err != nil {
 		_ = s.Close()
 		return nil, err
 	}
 	return s, nil
 }
 
+// controlFlowExecs are built-in executables that change the control flow.
+var controlFlowExecs = map[string]struct{}{
+	"accept": {},
+	"reject": {},
+	"return": {},
+	"goto":   {},
+	"jump":   {},
+}
+
+func checkNoControlFlow(rs []RuleConfig) error {
+	for i, r := range rs {
+		if _, ok := controlFlowExecs[r.Type]; ok {
+			return fmt.Errorf("rule #%d: %s can not be used here", i, r.Type)
+		}
+		if err := checkNoControlFlow(r.Then); err != nil {
+			return fmt.Errorf("rule #%d then: %w", i, err)
+		}
+		if err := checkNoControlFlow(r.Else); err != nil {
+			return fmt.Errorf("rule #%d else: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Api returns the api of s.
+//
+//	POST /trace  runs a query with tracing. See TraceRequest and TraceResponse.
+//	GET  /stats  returns per-rule stats, if they are enabled. See RuleStats.
+func (s *Sequence) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Post("/trace", s.serveTrace)
+	if s.statsEnabled {
+		r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(s.Stats())
+		})
+	}
+	return r
+}
+
 func (s *Sequence) Exec(ctx context.Context, qCtx *query_context.Context) error {
 	walker := NewChainWalker(s.chain, nil)
-	return walker.ExecNext(ctx, qCtx)
+	err := walker.ExecNext(ctx, qCtx)
+	if len(s.finally) > 0 {
+		fw := NewChainWalker(s.finally, nil)
+		if fErr := fw.ExecNext(ctx, qCtx); fErr != nil {
+			s.logger.Warn("finally rules failed", qCtx.InfoField(), zap.Error(fErr))
+		}
+	}
+	return err
 }
@@ -22,7 +22,9 @@ package sequence
 import (
 	"context"
 	"errors"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
@@ -161,6 +163,61 @@ func Test_sequence_Exec(t *testing.T) {
 			wantErr:    false,
 			wantTarget: true,
 		},
+		{
+			name: "if then",
+			ra: []RuleArgs{
+				{
+					If:   []any{"$true", "$true"},
+					Then: []RuleArgs{{Exec: "$target"}, {Exec: "return"}},
+					Else: []RuleArgs{{Exec: "$err"}},
+				},
+				{Exec: "$err"}, // return in block skips the rest of the sequence.
+			},
+			wantErr:    false,
+			wantTarget: true,
+		},
+		{
+			name: "if else",
+			ra: []RuleArgs{
+				{
+					If:   []any{"$true", "$false"},
+					Then: []RuleArgs{{Exec: "$err"}},
+					Else: []RuleArgs{{Exec: "$nop"}},
+				},
+				{Exec: "$target"}, // continue after block.
+			},
+			wantErr:    false,
+			wantTarget: true,
+		},
+		{
+			name: "nested block and groups",
+			ra: []RuleArgs{
+				{
+					If: []any{map[string]any{"any": []any{"$false", "$true"}}},
+					Then: []RuleArgs{
+						{
+							If:   []any{map[string]any{"all": []any{"$true", "$false"}}},
+							Then: []RuleArgs{{Exec: "$err"}},
+						},
+						{Exec: "$target"},
+					},
+				},
+			},
+			wantErr:    false,
+			wantTarget: true,
+		},
+		{
+			name: "if without else not matched",
+			ra: []RuleArgs{
+				{
+					If:   []any{"$false"},
+					Then: []RuleArgs{{Exec: "$err"}},
+				},
+				{Exec: "$target"},
+			},
+			wantErr:    false,
+			wantTarget: true,
+		},
 		{
 			name: "reject",
 			ra: []RuleArgs{
@@ -197,3 +254,222 @@ func Test_sequence_Exec(t *testing.T) {
 		})
 	}
 }
+
+func Test_sequence_Stats(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	s, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{Rules: []RuleArgs{
+		{Matches: []string{"$false"}, Exec: "$nop"},
+		{Matches: []string{"$true"}, Exec: "$nop"},
+		{If: []any{"$true"}, Then: []RuleArgs{{Exec: "$target"}}},
+		{Exec: "$err"},
+	}, Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		qCtx := query_context.NewContext(new(dns.Msg))
+		if err := s.Exec(context.Background(), qCtx); err == nil {
+			t.Fatal("want err")
+		}
+	}
+
+	type counts struct {
+		rule                   string
+		matched, execs, errors uint64
+	}
+	want := []counts{
+		{"r0", 0, 0, 0},
+		{"r1", 2, 2, 0}, // dummy is recursive, errors of following rules are not its.
+		{"r2", 2, 0, 0},
+		{"r2.then.r0", 2, 2, 0},
+		{"r3", 2, 2, 2},
+	}
+	stats := s.Stats()
+	if len(stats) != len(want) {
+		t.Fatalf("got %d stats, want %d", len(stats), len(want))
+	}
+	for i, st := range stats {
+		got := counts{st.Rule, st.Matched, st.Execs, st.Errors}
+		if got != want[i] {
+			t.Errorf("stats #%d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+// Time of following rules is not counted for recursive executables.
+func Test_sequence_StatsRecursiveTime(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	ps["slow"] = ExecutableFunc(func(context.Context, *query_context.Context) error {
+		time.Sleep(time.Millisecond * 50)
+		return nil
+	})
+	s, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{Rules: []RuleArgs{
+		{Exec: "$nop"},
+		{Exec: "$slow"},
+	}, Stats: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Exec(context.Background(), query_context.NewContext(new(dns.Msg))); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if d := stats[0].ExecTimeMs; d >= 25 {
+		t.Errorf("recursive rule time includes following rules, got %vms", d)
+	}
+	if d := stats[1].ExecTimeMs; d < 50 {
+		t.Errorf("slow rule time = %vms, want >= 50ms", d)
+	}
+}
+
+type sideEffect struct{ executed bool }
+
+func (s *sideEffect) Exec(_ context.Context, qCtx *query_context.Context) error {
+	s.executed = true
+	qCtx.SetMark(1)
+	return nil
+}
+
+func (s *sideEffect) HasSideEffects() bool { return true }
+
+func Test_sequence_ExecTrace(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	se := new(sideEffect)
+	ps["se"] = se
+	s, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{Rules: []RuleArgs{
+		{Matches: []string{"$true", "$false"}, Exec: "$err"},
+		{If: []any{"$false"}, Then: []RuleArgs{{Exec: "$err"}}, Else: []RuleArgs{{Exec: "$se"}}},
+		{Exec: "$target"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dryRun := range []bool{true, false} {
+		se.executed = false
+		tr := &Trace{DryRun: dryRun}
+		qCtx := query_context.NewContext(new(dns.Msg))
+		if err := s.ExecTrace(context.Background(), qCtx, tr); err != nil {
+			t.Fatal(err)
+		}
+		if se.executed == dryRun {
+			t.Errorf("dry run %v: side effect executed = %v", dryRun, se.executed)
+		}
+
+		nodes := tr.Nodes()
+		var rules []string
+		for _, n := range nodes {
+			rules = append(rules, n.Rule)
+		}
+		if want := []string{"r0", "r1", "r1.else.r0", "r2"}; !reflect.DeepEqual(rules, want) {
+			t.Fatalf("visited rules = %v, want %v", rules, want)
+		}
+		if n := nodes[0]; n.Executed || len(n.Matches) != 2 || n.Matches[1].Matched {
+			t.Errorf("unexpected node r0 %+v", n)
+		}
+		if n := nodes[1]; n.Executed || len(n.Matches) != 1 || n.Matches[0].Matched {
+			t.Errorf("unexpected node r1 %+v", n)
+		}
+		if n := nodes[2]; n.Skipped != dryRun || (len(n.MarksSet) == 1) == dryRun {
+			t.Errorf("unexpected node r1.else.r0 %+v", n)
+		}
+		if n := nodes[3]; !n.Executed || n.Response == nil {
+			t.Errorf("unexpected node r2 %+v", n)
+		}
+	}
+}
+
+type respRecorder struct {
+	r        *dns.Msg
+	executed bool
+}
+
+func (s *respRecorder) Exec(_ context.Context, qCtx *query_context.Context) error {
+	s.executed = true
+	s.r = qCtx.R()
+	return nil
+}
+
+func Test_sequence_Finally(t *testing.T) {
+	ps := make(map[string]any)
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	preparePlugins(ps)
+	rec := new(respRecorder)
+	ps["rec"] = rec
+
+	s, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{
+		Rules: []RuleArgs{
+			{Exec: "$target"},
+			{Exec: "accept"},
+			{Exec: "$err"}, // skipped
+		},
+		Finally: []RuleArgs{
+			{Exec: "$err"}, // logged only
+			{Exec: "$rec"}, // skipped
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx := query_context.NewContext(new(dns.Msg))
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatalf("finally error should not be returned, got %v", err)
+	}
+
+	s, err = newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{
+		Rules:   []RuleArgs{{Exec: "$target"}, {Exec: "$err"}},
+		Finally: []RuleArgs{{Exec: "$rec"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	qCtx = query_context.NewContext(new(dns.Msg))
+	if err := s.Exec(context.Background(), qCtx); err == nil {
+		t.Fatal("want error from rules")
+	}
+	if !rec.executed || rec.r != qCtx.R() || rec.r == nil {
+		t.Errorf("finally should run after an error and see the final response")
+	}
+
+	// A recursive executable that does not call next can not stop
+	// the finally rules.
+	rec.executed = false
+	ps["ret"] = &dummy{wantReturn: true}
+	s, err = newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{
+		Rules:   []RuleArgs{{Exec: "$target"}},
+		Finally: []RuleArgs{{Exec: "$ret"}, {Exec: "$rec"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Exec(context.Background(), query_context.NewContext(new(dns.Msg))); err != nil {
+		t.Fatal(err)
+	}
+	if !rec.executed {
+		t.Error("finally rules after a recursive executable were skipped")
+	}
+
+	for _, ra := range [][]RuleArgs{
+		{{Exec: "accept"}},
+		{{Matches: []string{"$true"}, Exec: "goto seq2"}},
+		{{If: []any{"$true"}, Then: []RuleArgs{{Exec: "$nop"}}, Else: []RuleArgs{{Exec: "return"}}}},
+	} {
+		if _, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{Finally: ra}); err == nil {
+			t.Errorf("control flow %+v in finally should be rejected", ra)
+		}
+	}
+
+	// Sequences with finally rules can not be reached by jump or goto.
+	ps["fin"] = s
+	for _, exec := range []string{"jump fin", "goto fin"} {
+		if _, err := newSequence(coremain.NewBP("test", m), "test", &ObjectArgs{Rules: []RuleArgs{{Exec: exec}}}); err == nil {
+			t.Errorf("%s should be rejected", exec)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ruleInfo describes a rule in the config.
+type ruleInfo struct {
+	seq     string // tag of the sequence
+	name    string // e.g. "r0", "r1.then.r0"
+	block   bool
+	matches []string // For blocks, it is the if.
+	exec    string
+}
+
+func newRuleInfo(seq, name string, r RuleConfig) *ruleInfo {
+	ri := &ruleInfo{seq: seq, name: name, block: r.isBlock()}
+	mcs := r.Matches
+	if ri.block {
+		mcs = r.If
+	} else {
+		ri.exec = r.execString()
+	}
+	for _, mc := range mcs {
+		ri.matches = append(ri.matches, mc.String())
+	}
+	return ri
+}
+
+// ruleStats counts hits of a rule.
+type ruleStats struct {
+	info *ruleInfo
+
+	matched  atomic.Uint64 // all matchers were matched. For blocks, if was matched.
+	execs    atomic.Uint64
+	errs     atomic.Uint64
+	execTime atomic.Int64 // nanoseconds
+}
+
+func (st *ruleStats) observeExec(start time.Time, err error) {
+	st.execs.Add(1)
+	st.execTime.Add(int64(time.Since(start)))
+	if err != nil {
+		st.errs.Add(1)
+	}
+}
+
+// observeRecursiveExec is like observeExec, but time and errors of
+// following rules that were run by the executable are excluded.
+func (st *ruleStats) observeRecursiveExec(start time.Time, err error, o *nextObserver) {
+	d := time.Since(start)
+	nd, nextErr := o.finish()
+	st.execs.Add(1)
+	st.execTime.Add(int64(max(d-nd, 0)))
+	if err != nil && (nextErr == nil || !errors.Is(err, nextErr)) {
+		st.errs.Add(1)
+	}
+}
+
+// RuleStats is a snapshot of a ruleStats.
+type RuleStats struct {
+	Rule    string   `json:"rule"`
+	Matches []string `json:"matches,omitempty"`
+	Exec    string   `json:"exec,omitempty"`
+
+	// For recursive executables (e.g. cache), Errors and ExecTimeMs
+	// don't include following rules that they run. But for jump, they
+	// include rules of the target sequence.
+	Matched    uint64  `json:"matched"`
+	Execs      uint64  `json:"execs"`
+	Errors     uint64  `json:"errors"`
+	ExecTimeMs float64 `json:"exec_time_ms"` // cumulative
+}
+
+func (st *ruleStats) snapshot() RuleStats {
+	return RuleStats{
+		Rule:       st.info.name,
+		Matches:    st.info.matches,
+		Exec:       st.info.exec,
+		Matched:    st.matched.Load(),
+		Execs:      st.execs.Load(),
+		Errors:     st.errs.Load(),
+		ExecTimeMs: float64(st.execTime.Load()) / float64(time.Millisecond),
+	}
+}
+
+// statsMatch counts matched if-conditions of blocks. Because condition
+// nodes of blocks match the reversed if.
+type statsMatch struct {
+	m  Matcher
+	st *ruleStats
+}
+
+func (s statsMatch) Match(ctx context.Context, qCtx *query_context.Context) (bool, error) {
+	ok, err := s.m.Match(ctx, qCtx)
+	if err != nil {
+		s.st.errs.Add(1)
+		return false, err
+	}
+	if ok {
+		s.st.matched.Add(1)
+	}
+	return ok, nil
+}
+
+// Stats returns stats of all rules in the order of the config.
+// It returns nil if stats are not enabled.
+func (s *Sequence) Stats() []RuleStats {
+	if len(s.stats) == 0 {
+		return nil
+	}
+	l := make([]RuleStats, 0, len(s.stats))
+	for _, st := range s.stats {
+		l = append(l, st.snapshot())
+	}
+	return l
+}
+
+func (s *Sequence) regMetricsTo(r prometheus.Registerer, tag string) error {
+	for _, st := range s.stats {
+		lb := map[string]string{"tag": tag, "rule": st.info.name}
+		collectors := [...]prometheus.Collector{
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "rule_matched_total",
+				Help:        "The total number of times that the rule was matched",
+				ConstLabels: lb,
+			}, func() float64 { return float64(st.matched.Load()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "rule_exec_total",
+				Help:        "The total number of times that the rule was executed",
+				ConstLabels: lb,
+			}, func() float64 { return float64(st.execs.Load()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "rule_error_total",
+				Help:        "The total number of errors from the rule",
+				ConstLabels: lb,
+			}, func() float64 { return float64(st.errs.Load()) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "rule_exec_seconds_total",
+				Help:        "The cumulative exec time of the rule in seconds",
+				ConstLabels: lb,
+			}, func() float64 { return time.Duration(st.execTime.Load()).Seconds() }),
+		}
+		for _, c := range collectors {
+			if err := r.Register(c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (mc MatchConfig) String() string {
+	var s string
+	switch {
+	case len(mc.Any) > 0 || len(mc.All) > 0:
+		g, op := mc.All, "all"
+		if len(mc.Any) > 0 {
+			g, op = mc.Any, "any"
+		}
+		ss := make([]string, 0, len(g))
+		for _, c := range g {
+			ss = append(ss, c.String())
+		}
+		s = fmt.Sprintf("%s(%s)", op, strings.Join(ss, ", "))
+	case len(mc.Tag) > 0:
+		s = joinArgs("$"+mc.Tag, mc.Args)
+	default:
+		s = joinArgs(mc.Type, mc.Args)
+	}
+	if mc.Reverse {
+		s = "!" + s
+	}
+	return s
+}
+
+func (rc RuleConfig) execString() string {
+	if len(rc.Tag) > 0 {
+		return joinArgs("$"+rc.Tag, rc.Args)
+	}
+	return joinArgs(rc.Type, rc.Args)
+}
+
+func joinArgs(p, args string) string {
+	if len(args) == 0 {
+		return p
+	}
+	return p + " " + args
+}
@@ -0,0 +1,328 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sequence
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+)
+
+const traceTimeout = time.Second * 5
+
+// activeTraces is the number of running traces. ChainWalker only
+// looks for the Trace in the context if it is not zero, so
+// normal queries are not slowed down by tracing.
+var activeTraces atomic.Int32
+
+type traceCtxKey struct{}
+
+// Trace records rules that a query walked through.
+// It is safe for concurrent use.
+type Trace struct {
+	// DryRun skips executables that have side effects and marks the
+	// query as a dry run, so plugins (e.g. cache) don't store anything.
+	// See SideEffectReporter and query_context.Context.SetDryRun.
+	DryRun bool
+
+	mu    sync.Mutex
+	nodes []TraceNode
+}
+
+// TraceNode is a rule that was visited.
+type TraceNode struct {
+	Sequence string        `json:"sequence"`
+	Rule     string        `json:"rule"`
+	Exec     string        `json:"exec,omitempty"`
+	Matches  []MatchResult `json:"matches,omitempty"`
+	Executed bool          `json:"executed"`          // matched and the exec was reached.
+	Skipped  bool          `json:"skipped,omitempty"` // the exec was skipped by dry run.
+
+	// Changes by the exec. Note that for recursive executables
+	// (e.g. cache, jump), they include changes and time of following rules.
+	MarksSet []uint32       `json:"marks_set,omitempty"`
+	Response *ResponseDelta `json:"response,omitempty"`
+	TimeMs   float64        `json:"time_ms"`
+	Error    string         `json:"error,omitempty"`
+}
+
+type MatchResult struct {
+	Matcher string `json:"matcher"`
+	Matched bool   `json:"matched"`
+	Error   string `json:"error,omitempty"`
+}
+
+type ResponseDelta struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+// Nodes returns a copy of the recorded nodes.
+func (t *Trace) Nodes() []TraceNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return slices.Clone(t.nodes)
+}
+
+func (t *Trace) add(n TraceNode) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes = append(t.nodes, n)
+	return len(t.nodes) - 1
+}
+
+func (t *Trace) update(i int, f func(n *TraceNode)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.nodes[i])
+}
+
+// ExecTrace executes qCtx and records visited rules to t.
+func (s *Sequence) ExecTrace(ctx context.Context, qCtx *query_context.Context, t *Trace) error {
+	activeTraces.Add(1)
+	defer activeTraces.Add(-1)
+	if t.DryRun {
+		qCtx.SetDryRun()
+	}
+	return s.Exec(context.WithValue(ctx, traceCtxKey{}, t), qCtx)
+}
+
+func traceFromContext(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceCtxKey{}).(*Trace)
+	return t
+}
+
+// execNextTrace is ExecNext with tracing. Rule stats are not updated.
+func (w *ChainWalker) execNextTrace(ctx context.Context, qCtx *query_context.Context, t *Trace) error {
+	p := w.p
+	for p < len(w.chain) {
+		n := w.chain[p]
+		if n.info == nil { // Not a rule. It must be a skip node.
+			p = n.skipTo
+			continue
+		}
+
+		tn := TraceNode{Sequence: n.info.seq, Rule: n.info.name, Exec: n.info.exec}
+		matched, err := traceMatches(ctx, qCtx, n, &tn)
+		if err != nil {
+			t.add(tn)
+			return err
+		}
+		if !matched {
+			t.add(tn)
+			p++
+			continue
+		}
+		if n.skipTo > 0 { // Block whose if was not matched.
+			t.add(tn)
+			p = n.skipTo
+			continue
+		}
+
+		tn.Executed = true
+		tn.Skipped = t.DryRun && hasSideEffects(n)
+		marks := qCtx.Marks()
+		r := qCtx.R()
+		start := time.Now()
+		finish := func(tn *TraceNode, err error) {
+			tn.TimeMs = float64(time.Since(start)) / float64(time.Millisecond)
+			for _, m := range qCtx.Marks() {
+				if _, ok := slices.BinarySearch(marks, m); !ok {
+					tn.MarksSet = append(tn.MarksSet, m)
+				}
+			}
+			if nr := qCtx.R(); nr != r || respSummary(nr) != respSummary(r) {
+				tn.Response = &ResponseDelta{Before: respSummary(r), After: respSummary(nr)}
+			}
+			if err != nil {
+				tn.Error = err.Error()
+			}
+		}
+
+		switch {
+		case n.E != nil:
+			var err error
+			if !tn.Skipped {
+				err = n.E.Exec(ctx, qCtx)
+			}
+			finish(&tn, err)
+			t.add(tn)
+			if err != nil {
+				return err
+			}
+			p++
+		case n.RE != nil:
+			next := ChainWalker{
+				p:        p + 1,
+				chain:    w.chain,
+				jumpBack: w.jumpBack,
+			}
+			i := t.add(tn)
+			var err error
+			if tn.Skipped {
+				err = next.ExecNext(ctx, qCtx)
+			} else {
+				err = n.RE.Exec(ctx, qCtx, next)
+			}
+			t.update(i, func(tn *TraceNode) { finish(tn, err) })
+			return err
+		default:
+			panic("n cannot be executed")
+		}
+	}
+
+	if w.jumpBack != nil {
+		return w.jumpBack.ExecNext(ctx, qCtx)
+	}
+	return nil
+}
+
+// traceMatches evaluates matchers of n and records results to tn.
+// For blocks, it records and returns the result of the reversed if.
+func traceMatches(ctx context.Context, qCtx *query_context.Context, n *ChainNode, tn *TraceNode) (bool, error) {
+	for i, match := range n.Matches {
+		ok, err := match.Match(ctx, qCtx)
+		mr := MatchResult{Matched: ok}
+		if n.info.block {
+			mr.Matcher = "if " + strings.Join(n.info.matches, ", ")
+			mr.Matched = !ok && err == nil
+		} else if i < len(n.info.matches) {
+			mr.Matcher = n.info.matches[i]
+		}
+		if err != nil {
+			mr.Error = err.Error()
+			tn.Error = err.Error()
+		}
+		tn.Matches = append(tn.Matches, mr)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func hasSideEffects(n *ChainNode) bool {
+	var e any = n.RE
+	if n.E != nil {
+		e = n.E
+	}
+	r, ok := e.(SideEffectReporter)
+	return ok && r.HasSideEffects()
+}
+
+func respSummary(r *dns.Msg) string {
+	if r == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%s, %d answers", dns.RcodeToString[r.Rcode], len(r.Answer))
+}
+
+// TraceRequest is the body of the "/trace" api.
+type TraceRequest struct {
+	QName      string `json:"qname"`
+	QType      string `json:"qtype"` // Name or number. Default is A.
+	ClientIP   string `json:"client_ip"`
+	ServerMeta struct {
+		FromUDP    bool   `json:"from_udp"`
+		ServerName string `json:"server_name"`
+		UrlPath    string `json:"url_path"`
+	} `json:"server_meta"`
+
+	// DryRun skips executables that have side effects (e.g. ipset, nftset)
+	// and stops plugins from storing the result (e.g. cache).
+	DryRun bool `json:"dry_run"`
+}
+
+// TraceResponse is the response of the "/trace" api.
+type TraceResponse struct {
+	Nodes    []TraceNode `json:"nodes"`
+	Marks    []uint32    `json:"marks,omitempty"`
+	Response string      `json:"response,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+func (req *TraceRequest) newContext() (*query_context.Context, error) {
+	if len(req.QName) == 0 {
+		return nil, errors.New("missing qname")
+	}
+	qt := uint16(dns.TypeA)
+	if len(req.QType) > 0 {
+		t, ok := utils.ParseNameOrNum(strings.ToUpper(req.QType), dns.StringToType)
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype %s", req.QType)
+		}
+		qt = t
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(req.QName), qt)
+
+	qCtx := query_context.NewContext(q)
+	if len(req.ClientIP) > 0 {
+		addr, err := netip.ParseAddr(req.ClientIP)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client_ip, %w", err)
+		}
+		qCtx.ServerMeta.ClientAddr = addr
+	}
+	qCtx.ServerMeta.FromUDP = req.ServerMeta.FromUDP
+	qCtx.ServerMeta.ServerName = req.ServerMeta.ServerName
+	qCtx.ServerMeta.UrlPath = req.ServerMeta.UrlPath
+	return qCtx, nil
+}
+
+func (s *Sequence) serveTrace(w http.ResponseWriter, req *http.Request) {
+	tr := new(TraceRequest)
+	if err := json.NewDecoder(req.Body).Decode(tr); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body, %s", err), http.StatusBadRequest)
+		return
+	}
+	qCtx, err := tr.newContext()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), traceTimeout)
+	defer cancel()
+	t := &Trace{DryRun: tr.DryRun}
+	err = s.ExecTrace(ctx, qCtx, t)
+
+	resp := TraceResponse{Nodes: t.Nodes(), Marks: qCtx.Marks()}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if r := qCtx.R(); r != nil {
+		resp.Response = r.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,353 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sub_query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "sub_query"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+const (
+	defaultMaxDepth = 3
+	maxSubQueries   = 8 // per Exec
+
+	modeMerge      = "merge"
+	modeMergeExtra = "merge_extra"
+	modeStore      = "store"
+
+	phQName = "{qname}"
+	phCNAME = "{cname}"
+	phSRV   = "{srv}"
+)
+
+var (
+	errTooDeep = errors.New("sub query depth limit exceeded")
+	errLoop    = errors.New("sub query loop detected")
+)
+
+// resultsKey is the key of sub query results stored by "store" mode.
+var resultsKey = query_context.RegKey()
+
+type Args struct {
+	// Sequence is the tag of the executable (usually a sequence) that
+	// resolves sub queries.
+	Sequence string `yaml:"sequence"`
+
+	// QName is the name template of sub queries. Default is "{qname}".
+	// Placeholders:
+	//  {qname}: the query name.
+	//  {cname}: the final CNAME target in the current response.
+	//  {srv}:   targets of SRV records in the current response.
+	// For {cname} and {srv}, a sub query is sent for each value (up to 8).
+	// If there is no value, no sub query will be sent.
+	QName string `yaml:"qname"`
+
+	// QType is the type of sub queries, name or number.
+	// Default is the type of the query.
+	QType string `yaml:"qtype"`
+
+	// Mode is what to do with successful sub query responses.
+	//  merge:       append answers to the answer section of the current response.
+	//  merge_extra: append answers to the additional section of the current response.
+	//  store:       store responses to the query context. See Results.
+	// Merge modes do nothing if there is no current response.
+	// Default is merge.
+	Mode string `yaml:"mode"`
+
+	// Mark, if not 0, will be set if any sub query got answers. It can be used by
+	// the "mark" matcher in later rules.
+	Mark uint32 `yaml:"mark"`
+
+	// MaxDepth is the maximum level of nested sub queries. Default is 3.
+	MaxDepth int `yaml:"max_depth"`
+}
+
+var _ sequence.Executable = (*SubQuery)(nil)
+
+// SubQuery resolves another name through an executable.
+type SubQuery struct {
+	tag      string
+	e        sequence.Executable
+	qname    string
+	qtype    uint16 // 0 means the query type.
+	mode     string
+	mark     uint32
+	maxDepth int
+	logger   *zap.Logger
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewSubQuery(bp, args.(*Args))
+}
+
+func NewSubQuery(bq sequence.BQ, args *Args) (*SubQuery, error) {
+	tag := strings.TrimPrefix(args.Sequence, "$")
+	if len(tag) == 0 {
+		return nil, errors.New("missing sequence tag")
+	}
+	e := sequence.ToExecutable(bq.M().GetPlugin(tag))
+	if e == nil {
+		return nil, fmt.Errorf("can not find executable %s", tag)
+	}
+	utils.SetDefaultString(&args.QName, phQName)
+	utils.SetDefaultString(&args.Mode, modeMerge)
+	utils.SetDefaultUnsignNum(&args.MaxDepth, defaultMaxDepth)
+
+	if strings.Contains(args.QName, phCNAME) && strings.Contains(args.QName, phSRV) {
+		return nil, fmt.Errorf("invalid qname %s, {cname} and {srv} can not be used together", args.QName)
+	}
+	var qtype uint16
+	if len(args.QType) > 0 {
+		t, ok := utils.ParseNameOrNum(strings.ToUpper(args.QType), dns.StringToType)
+		if !ok {
+			return nil, fmt.Errorf("invalid qtype %s", args.QType)
+		}
+		qtype = t
+	}
+	switch args.Mode {
+	case modeMerge, modeMergeExtra, modeStore:
+	default:
+		return nil, fmt.Errorf("invalid mode %s", args.Mode)
+	}
+
+	return &SubQuery{
+		tag:      tag,
+		e:        e,
+		qname:    args.QName,
+		qtype:    qtype,
+		mode:     args.Mode,
+		mark:     args.Mark,
+		maxDepth: args.MaxDepth,
+		logger:   bq.L(),
+	}, nil
+}
+
+// subQueryCtxKey is the context key of the sub query stack.
+type subQueryCtxKey struct{}
+
+// stackEntry is a question that is being resolved by a sub query.
+type stackEntry struct {
+	name  string
+	qtype uint16
+}
+
+// Exec sends sub queries. A failed sub query is logged and skipped,
+// unless it is a loop or too deep.
+func (s *SubQuery) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	stack, _ := ctx.Value(subQueryCtxKey{}).([]stackEntry)
+	if len(stack) == 0 { // Not a sub query. Seed the stack with the query.
+		q := qCtx.QQuestion()
+		stack = []stackEntry{{name: strings.ToLower(q.Name), qtype: q.Qtype}}
+	}
+	if len(stack) > s.maxDepth { // The first entry is the original query.
+		return errTooDeep
+	}
+	qtype := s.qtype
+	if qtype == 0 {
+		qtype = qCtx.QQuestion().Qtype
+	}
+
+	for _, name := range s.names(qCtx) {
+		se := stackEntry{name: strings.ToLower(name), qtype: qtype}
+		for _, e := range stack {
+			if e == se {
+				return fmt.Errorf("%w, %s %s", errLoop, name, dns.TypeToString[qtype])
+			}
+		}
+		subStack := append(stack[:len(stack):len(stack)], se)
+		r, err := s.query(context.WithValue(ctx, subQueryCtxKey{}, subStack), qCtx, name, qtype)
+		if err != nil {
+			if errors.Is(err, errLoop) || errors.Is(err, errTooDeep) {
+				return fmt.Errorf("sub query %s failed, %w", name, err)
+			}
+			s.logger.Warn("sub query failed", zap.String("name", name), qCtx.InfoField(), zap.Error(err))
+			continue
+		}
+		s.handleResp(qCtx, r)
+	}
+	return nil
+}
+
+// names returns names of sub queries.
+func (s *SubQuery) names(qCtx *query_context.Context) []string {
+	var values []string
+	var ph string
+	switch {
+	case strings.Contains(s.qname, phCNAME):
+		ph, values = phCNAME, cnameTargets(qCtx.R())
+	case strings.Contains(s.qname, phSRV):
+		ph, values = phSRV, srvTargets(qCtx.R())
+	default:
+		return []string{dns.Fqdn(strings.ReplaceAll(s.qname, phQName, qCtx.QQuestion().Name))}
+	}
+	if len(values) > maxSubQueries {
+		values = values[:maxSubQueries]
+	}
+	names := make([]string, 0, len(values))
+	for _, v := range values {
+		n := strings.ReplaceAll(s.qname, ph, v)
+		n = strings.ReplaceAll(n, phQName, qCtx.QQuestion().Name)
+		names = append(names, dns.Fqdn(n))
+	}
+	return names
+}
+
+func (s *SubQuery) query(ctx context.Context, qCtx *query_context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = qCtx.Q().RecursionDesired
+	if opt := qCtx.ClientOpt(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	subCtx := query_context.NewContext(m)
+	subCtx.ServerMeta = qCtx.ServerMeta
+	if qCtx.DryRun() {
+		subCtx.SetDryRun()
+	}
+	if err := s.e.Exec(ctx, subCtx); err != nil {
+		return nil, err
+	}
+	return subCtx.R(), nil
+}
+
+func (s *SubQuery) handleResp(qCtx *query_context.Context, r *dns.Msg) {
+	if r == nil || r.Rcode != dns.RcodeSuccess {
+		return
+	}
+	if s.mark > 0 && len(r.Answer) > 0 {
+		qCtx.SetMark(s.mark)
+	}
+
+	if s.mode == modeStore {
+		l, _ := qCtx.GetValue(resultsKey)
+		rs, _ := l.([]*dns.Msg)
+		qCtx.StoreValue(resultsKey, append(rs[:len(rs):len(rs)], r))
+		return
+	}
+
+	resp := qCtx.R()
+	if resp == nil {
+		s.logger.Debug("no response to merge sub query into", qCtx.InfoField())
+		return
+	}
+	section := &resp.Answer
+	if s.mode == modeMergeExtra {
+		section = &resp.Extra
+	}
+	for _, rr := range r.Answer {
+		if !hasDuplicate(rr, resp.Answer) && !hasDuplicate(rr, resp.Extra) {
+			*section = append(*section, dns.Copy(rr))
+		}
+	}
+}
+
+// Results returns sub query responses stored by "store" mode.
+func Results(qCtx *query_context.Context) []*dns.Msg {
+	v, _ := qCtx.GetValue(resultsKey)
+	rs, _ := v.([]*dns.Msg)
+	return rs
+}
+
+// cnameTargets returns the final target of the CNAME chain in r.
+func cnameTargets(r *dns.Msg) []string {
+	if r == nil {
+		return nil
+	}
+	owners := make(map[string]struct{})
+	var targets []string
+	for _, rr := range r.Answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			owners[strings.ToLower(c.Hdr.Name)] = struct{}{}
+			targets = append(targets, c.Target)
+		}
+	}
+	var final []string
+	for _, t := range targets {
+		if _, ok := owners[strings.ToLower(t)]; !ok && !containsName(final, t) {
+			final = append(final, t)
+		}
+	}
+	return final
+}
+
+func srvTargets(r *dns.Msg) []string {
+	if r == nil {
+		return nil
+	}
+	var targets []string
+	for _, rr := range r.Answer {
+		if srv, ok := rr.(*dns.SRV); ok && srv.Target != "." && !containsName(targets, srv.Target) {
+			targets = append(targets, srv.Target)
+		}
+	}
+	return targets
+}
+
+func hasDuplicate(rr dns.RR, l []dns.RR) bool {
+	for _, r := range l {
+		if dns.IsDuplicate(rr, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(l []string, n string) bool {
+	for _, s := range l {
+		if strings.EqualFold(s, n) {
+			return true
+		}
+	}
+	return false
+}
+
+// QuickSetup format: sequence_tag [qname_template [qtype]]
+// e.g. "seq_remote {cname}", "seq_local {srv} A".
+// Responses are merged into the current response.
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	fs := strings.Fields(s)
+	if len(fs) == 0 || len(fs) > 3 {
+		return nil, fmt.Errorf("expect 1 to 3 fields, got %d", len(fs))
+	}
+	args := &Args{Sequence: fs[0]}
+	if len(fs) > 1 {
+		args.QName = fs[1]
+	}
+	if len(fs) > 2 {
+		args.QType = fs[2]
+	}
+	return NewSubQuery(bq, args)
+}
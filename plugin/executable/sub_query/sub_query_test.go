@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package sub_query
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// resolver answers every A query with 1.1.1.1 and records query names.
+type resolver struct {
+	names []string
+	next  func(ctx context.Context, qCtx *query_context.Context) error
+}
+
+func (r *resolver) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.QQuestion()
+	r.names = append(r.names, q.Name)
+	if r.next != nil {
+		return r.next(ctx, qCtx)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(qCtx.Q())
+	resp.Answer = append(resp.Answer, newA(q.Name))
+	qCtx.SetResponse(resp)
+	return nil
+}
+
+func newA(name string) dns.RR {
+	return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(1, 1, 1, 1)}
+}
+
+func newCNAME(name, target string) dns.RR {
+	return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+}
+
+func newTestSubQuery(t *testing.T, r *resolver, args *Args) *SubQuery {
+	t.Helper()
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"r": r})
+	args.Sequence = "r"
+	s, err := NewSubQuery(coremain.NewBP("test", m), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSubQuery_merge(t *testing.T) {
+	r := new(resolver)
+	s := newTestSubQuery(t, r, &Args{QName: "{cname}"})
+
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	resp := new(dns.Msg).SetReply(qCtx.Q())
+	resp.Answer = []dns.RR{newCNAME("example.com.", "a.cdn."), newCNAME("a.cdn.", "b.cdn.")}
+	qCtx.SetResponse(resp)
+
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.names) != 1 || r.names[0] != "b.cdn." {
+		t.Fatalf("sub queries = %v, want [b.cdn.]", r.names)
+	}
+	if n := len(qCtx.R().Answer); n != 3 {
+		t.Fatalf("want 3 answers after merge, got %d", n)
+	}
+}
+
+func TestSubQuery_store(t *testing.T) {
+	r := new(resolver)
+	s := newTestSubQuery(t, r, &Args{QName: "canary.{qname}", Mode: "store", Mark: 1})
+
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() != nil {
+		t.Fatal("store mode should not set the response")
+	}
+	rs := Results(qCtx)
+	if len(rs) != 1 || rs[0].Question[0].Name != "canary.example.com." {
+		t.Fatalf("unexpected results %v", rs)
+	}
+	if !qCtx.HasMark(1) {
+		t.Fatal("mark is not set")
+	}
+}
+
+func TestSubQuery_loop(t *testing.T) {
+	// r resolves names by sub querying them again.
+	r := new(resolver)
+	s := newTestSubQuery(t, r, &Args{QName: "x.{qname}", MaxDepth: 2})
+	r.next = s.Exec
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	if err := s.Exec(context.Background(), qCtx); !errors.Is(err, errTooDeep) {
+		t.Fatalf("want errTooDeep, got %v", err)
+	}
+	if len(r.names) != 2 {
+		t.Fatalf("want 2 sub queries, got %v", r.names)
+	}
+
+	r = new(resolver)
+	s = newTestSubQuery(t, r, &Args{QName: "a.com"})
+	r.next = s.Exec
+	if err := s.Exec(context.Background(), qCtx); !errors.Is(err, errLoop) {
+		t.Fatalf("want errLoop, got %v", err)
+	}
+
+	// A sub query of the query itself is a loop.
+	r = new(resolver)
+	s = newTestSubQuery(t, r, &Args{})
+	if err := s.Exec(context.Background(), qCtx); !errors.Is(err, errLoop) {
+		t.Fatalf("want errLoop, got %v", err)
+	}
+	if len(r.names) != 0 {
+		t.Fatalf("want no sub query, got %v", r.names)
+	}
+}
+
+func TestSubQuery_failed(t *testing.T) {
+	r := new(resolver)
+	r.next = func(_ context.Context, qCtx *query_context.Context) error {
+		q := qCtx.QQuestion()
+		if q.Name == "a.srv." {
+			return errors.New("timeout")
+		}
+		resp := new(dns.Msg).SetReply(qCtx.Q())
+		resp.Answer = append(resp.Answer, newA(q.Name))
+		qCtx.SetResponse(resp)
+		return nil
+	}
+	s := newTestSubQuery(t, r, &Args{QName: "{srv}", QType: "A", Mode: "merge_extra"})
+
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("_sip._udp.example.com.", dns.TypeSRV))
+	resp := new(dns.Msg).SetReply(qCtx.Q())
+	for _, target := range []string{"a.srv.", "b.srv."} {
+		resp.Answer = append(resp.Answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: "_sip._udp.example.com.", Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 300},
+			Target: target,
+		})
+	}
+	qCtx.SetResponse(resp)
+
+	if err := s.Exec(context.Background(), qCtx); err != nil {
+		t.Fatalf("a failed sub query should be skipped, got %v", err)
+	}
+	if len(r.names) != 2 {
+		t.Fatalf("want 2 sub queries, got %v", r.names)
+	}
+	if extra := qCtx.R().Extra; len(extra) != 1 || extra[0].Header().Name != "b.srv." {
+		t.Fatalf("unexpected additional section %v", extra)
+	}
+}
+
+func TestSubQuery_dryRun(t *testing.T) {
+	r := new(resolver)
+	ps := map[string]any{"r": r}
+	m := coremain.NewTestMosdnsWithPlugins(ps)
+	bp := coremain.NewBP("test", m)
+	c := cache.NewCache(&cache.Args{Size: 1024}, cache.Opts{})
+	defer c.Close()
+	ps["cache"] = c
+	ps["has_resp"] = sequence.MatchFunc(func(_ context.Context, qCtx *query_context.Context) (bool, error) {
+		return qCtx.R() != nil, nil
+	})
+	inner, err := sequence.NewSequence(bp, []sequence.RuleArgs{
+		{Exec: "$cache"},
+		{Matches: []string{"$has_resp"}, Exec: "accept"},
+		{Exec: "$r"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps["inner"] = inner
+	sq, err := NewSubQuery(bp, &Args{Sequence: "inner", QName: "canary.{qname}", Mode: "store"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps["sq"] = sq
+	outer, err := sequence.NewSequence(bp, []sequence.RuleArgs{{Exec: "$sq"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newQCtx := func() *query_context.Context {
+		return query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+	}
+	if err := outer.ExecTrace(context.Background(), newQCtx(), &sequence.Trace{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	// The dry run must not fill the cache, so r is queried again
+	// by the first query, and only by it.
+	for i := 0; i < 2; i++ {
+		if err := outer.Exec(context.Background(), newQCtx()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(r.names) != 2 {
+		t.Fatalf("want 2 queries to the resolver, got %v", r.names)
+	}
+}
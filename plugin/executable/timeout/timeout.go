@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package timeout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"go.uber.org/zap"
+)
+
+const PluginType = "timeout"
+
+func init() {
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var errTimeout = errors.New("timeout")
+
+var _ sequence.Executable = (*Timeout)(nil)
+
+// Timeout runs an executable with a timeout. If the executable does not
+// finish in time, it is cancelled and the chain continues.
+type Timeout struct {
+	d      time.Duration
+	tag    string
+	e      sequence.Executable
+	logger *zap.Logger
+}
+
+func (t *Timeout) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	eCtx, cancel := context.WithTimeoutCause(ctx, t.d, errTimeout)
+	defer cancel()
+	err := t.e.Exec(eCtx, qCtx)
+	if err != nil && ctx.Err() == nil && errors.Is(context.Cause(eCtx), errTimeout) {
+		t.logger.Debug("exec timed out", zap.String("exec", t.tag), qCtx.InfoField(), zap.Error(err))
+		return nil
+	}
+	return err
+}
+
+// QuickSetup format: timeout_ms exec_tag
+// e.g. "500 forward_remote"
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	ms, tag, _ := strings.Cut(strings.TrimSpace(s), " ")
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "$")
+	n, err := strconv.Atoi(ms)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid timeout %s", ms)
+	}
+	if len(tag) == 0 {
+		return nil, errors.New("missing exec tag")
+	}
+	e := sequence.ToExecutable(bq.M().GetPlugin(tag))
+	if e == nil {
+		return nil, fmt.Errorf("can not find executable %s", tag)
+	}
+	return &Timeout{d: time.Duration(n) * time.Millisecond, tag: tag, e: e, logger: bq.L()}, nil
+}
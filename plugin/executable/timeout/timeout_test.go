@@ -0,0 +1,70 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package timeout
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+func TestTimeout_Exec(t *testing.T) {
+	slow := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		select {
+		case <-time.After(time.Second):
+			return nil
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	})
+	failed := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		return errors.New("err")
+	})
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"slow": slow, "failed": failed})
+	bq := coremain.NewBP("test", m)
+	qCtx := query_context.NewContext(new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+
+	e, err := QuickSetup(bq, "10 slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := e.(*Timeout).Exec(context.Background(), qCtx); err != nil {
+		t.Fatalf("timed out exec should not return an error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Millisecond*500 {
+		t.Fatalf("exec was not cancelled in time, took %s", d)
+	}
+
+	// Errors other than the timeout are returned.
+	e, err = QuickSetup(bq, "100 $failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.(*Timeout).Exec(context.Background(), qCtx); err == nil {
+		t.Fatal("want error")
+	}
+}
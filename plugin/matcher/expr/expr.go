@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package expr provides a matcher that evaluates a boolean expression.
+//
+// Syntax:
+//
+//	expr := expr || expr | expr && expr | !expr | (expr) | true | false
+//	      | bool_field | func(uint32) | field op value
+//	op := == != < <= > >= in prefix suffix contains regexp
+//	value := word | "quoted string" | [value, ...] | $tag
+//
+// Fields:
+//
+//	query:       qname qtype qclass rd cd ad edns do edns_udp_size
+//	server meta: client_ip from_udp server_name url_path
+//	response:    has_resp rcode answer_count min_ttl max_ttl resp_ip cname
+//	funcs:       mark(n) edns_opt(code)
+//
+// qtype, qclass and rcode accept names, e.g. "qtype in [A, AAAA]".
+// Ips accept cidrs, e.g. "client_ip in [10.0.0.0/8, ::1]".
+// "qname in $tag" and "cname in $tag" match domain sets,
+// "client_ip in $tag" and "resp_ip in $tag" match ip sets.
+// resp_ip and cname have multiple values, a comparison matches if any
+// value matches. Comparisons with fields that have no value (e.g. rcode
+// without a response) are false. "a != b" is the same as "!(a == b)".
+//
+// e.g. (client_ip in $kids_ips && qtype == AAAA) || url_path prefix "/kids"
+package expr
+
+import (
+	"context"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+const PluginType = "expr"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegMatchQuickSetup(PluginType, QuickSetup)
+}
+
+type Args struct {
+	Expr string `yaml:"expr"`
+}
+
+var _ sequence.Matcher = (*Matcher)(nil)
+
+type Matcher struct {
+	c cond
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewMatcher(bp, args.(*Args).Expr)
+}
+
+// NewMatcher compiles the expression s.
+func NewMatcher(bq sequence.BQ, s string) (*Matcher, error) {
+	c, err := compile(bq, s)
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{c: c}, nil
+}
+
+func (m *Matcher) Match(_ context.Context, qCtx *query_context.Context) (bool, error) {
+	return m.c(qCtx), nil
+}
+
+// QuickSetup format: expression
+// e.g. "qtype == AAAA && !mark(1)"
+func QuickSetup(bq sequence.BQ, s string) (sequence.Matcher, error) {
+	return NewMatcher(bq, s)
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package expr
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/domain_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/miekg/dns"
+)
+
+type testDomainSet struct{ m domain.Matcher[struct{}] }
+
+func (d testDomainSet) GetDomainMatcher() domain.Matcher[struct{}] { return d.m }
+
+type testIPSet struct{ m netlist.Matcher }
+
+func (d testIPSet) GetIPMatcher() netlist.Matcher { return d.m }
+
+func newTestBQ(t *testing.T) *coremain.BP {
+	t.Helper()
+	dm := domain.NewDomainMixMatcher()
+	if err := domain_set.LoadExps([]string{"ads.com"}, dm); err != nil {
+		t.Fatal(err)
+	}
+	l := netlist.NewList()
+	if err := ip_set.LoadFromIPs([]string{"192.168.0.0/16"}, l); err != nil {
+		t.Fatal(err)
+	}
+	l.Sort()
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{
+		"ads":  testDomainSet{m: dm},
+		"lan":  testIPSet{m: l},
+		"kids": testIPSet{m: l},
+	})
+	return coremain.NewBP("test", m)
+}
+
+func TestMatcher(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("WWW.Ads.com.", dns.TypeAAAA)
+	q.SetEdns0(1232, true)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.ClientAddr = netip.MustParseAddr("192.168.1.1")
+	qCtx.ServerMeta.UrlPath = "/kids/dns-query"
+	qCtx.SetMark(7)
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.ads.com.", Rrtype: dns.TypeCNAME, Ttl: 30}, Target: "cdn.example."},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "cdn.example.", Rrtype: dns.TypeAAAA, Ttl: 300}, AAAA: net.ParseIP("2001:db8::1")},
+	}
+	noResp := query_context.NewContext(q.Copy())
+
+	tests := []struct {
+		expr   string
+		resp   bool
+		want   bool
+		noResp bool // result without response
+	}{
+		{expr: "qname == www.ads.com", want: true},
+		{expr: `qname == "www.ads.com."`, want: true},
+		{expr: "qname in $ads && qtype == AAAA", want: true},
+		{expr: "qtype in [A, 28] && qclass == IN && rd", want: true},
+		{expr: "(client_ip in $kids && qtype == A) || url_path prefix \"/kids\"", want: true},
+		{expr: "client_ip in [10.0.0.0/8, ::1]", want: false},
+		{expr: "client_ip == 192.168.1.1 && !from_udp", want: true},
+		{expr: "do && edns && edns_udp_size >= 1232", want: true},
+		{expr: "mark(7) && !mark(8)", want: true},
+		{expr: "server_name regexp \"^$\" && url_path contains [dns, doh]", want: true},
+		{expr: "rcode == NOERROR && answer_count == 2", resp: true, want: true},
+		{expr: "min_ttl < 60 && max_ttl >= 300", resp: true, want: true},
+		{expr: "resp_ip in [2001:db8::/32] && cname == cdn.example", resp: true, want: true},
+		{expr: "rcode != SERVFAIL", resp: true, want: true, noResp: true},
+		{expr: "has_resp || false", resp: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			m, err := NewMatcher(newTestBQ(t), tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := qCtx
+			if tt.resp {
+				c = qCtx.Copy()
+				c.SetResponse(r)
+			}
+			if got, _ := m.Match(context.Background(), c); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+			if tt.resp {
+				if got, _ := m.Match(context.Background(), noResp); got != tt.noResp {
+					t.Errorf("Match() without response = %v, want %v", got, tt.noResp)
+				}
+			}
+		})
+	}
+}
+
+func TestMatcher_invalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"qname",
+		"unknown == 1",
+		"qtype == NOTATYPE",
+		"qtype prefix A",
+		"client_ip < 1.1.1.1",
+		"client_ip in $ads",
+		"qtype in $ads",
+		"rcode in $lan",
+		"qtype != $ads",
+		"qname in $lan",
+		"qname in $missing",
+		"qtype == A &&",
+		"(qtype == A",
+		"qtype == A)",
+		"mark(x)",
+		"rd = true",
+		`qname == "unterminated`,
+		"url_path regexp \"(\"",
+	} {
+		if _, err := NewMatcher(newTestBQ(t), s); err == nil {
+			t.Errorf("expression %q should be invalid", s)
+		}
+	}
+
+	if _, err := compileInt(fields["qtype"], "==", nil); err == nil {
+		t.Error("compileInt should reject empty values")
+	}
+}
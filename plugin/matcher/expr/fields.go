@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package expr
+
+import (
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+type fieldKind int
+
+const (
+	kindBool fieldKind = iota
+	kindInt
+	kindStr
+	kindIP
+)
+
+// field is a value of the query context. Int, string and ip fields call
+// f with each of their values and return true once f returns true. So a
+// comparison matches if any value matches. A field that has no value
+// (e.g. rcode without a response) matches nothing.
+type field struct {
+	kind fieldKind
+	b    func(qCtx *query_context.Context) bool
+	i    func(qCtx *query_context.Context, f func(int) bool) bool
+	s    func(qCtx *query_context.Context, f func(string) bool) bool
+	ip   func(qCtx *query_context.Context, f func(netip.Addr) bool) bool
+
+	// names maps names (upper case) to int values. e.g. "AAAA" for qtype.
+	names map[string]uint16
+
+	// domain string fields are normalized. See domain.NormalizeDomain.
+	domain bool
+}
+
+func boolField(g func(qCtx *query_context.Context) bool) *field {
+	return &field{kind: kindBool, b: g}
+}
+
+func intField(g func(qCtx *query_context.Context) (int, bool), names map[string]uint16) *field {
+	return &field{kind: kindInt, names: names, i: func(qCtx *query_context.Context, f func(int) bool) bool {
+		v, ok := g(qCtx)
+		return ok && f(v)
+	}}
+}
+
+func strField(g func(qCtx *query_context.Context) string) *field {
+	return &field{kind: kindStr, s: func(qCtx *query_context.Context, f func(string) bool) bool {
+		return f(g(qCtx))
+	}}
+}
+
+var rcodeNames = func() map[string]uint16 {
+	m := make(map[string]uint16)
+	for k, v := range dns.StringToRcode {
+		m[k] = uint16(v)
+	}
+	return m
+}()
+
+var fields = map[string]*field{
+	// query
+	"qname": {kind: kindStr, domain: true, s: func(qCtx *query_context.Context, f func(string) bool) bool {
+		return f(domain.NormalizeDomain(qCtx.QQuestion().Name))
+	}},
+	"qtype": intField(func(qCtx *query_context.Context) (int, bool) {
+		return int(qCtx.QQuestion().Qtype), true
+	}, dns.StringToType),
+	"qclass": intField(func(qCtx *query_context.Context) (int, bool) {
+		return int(qCtx.QQuestion().Qclass), true
+	}, dns.StringToClass),
+	"rd": boolField(func(qCtx *query_context.Context) bool { return qCtx.Q().RecursionDesired }),
+	"cd": boolField(func(qCtx *query_context.Context) bool { return qCtx.Q().CheckingDisabled }),
+	"ad": boolField(func(qCtx *query_context.Context) bool { return qCtx.Q().AuthenticatedData }),
+	"edns": boolField(func(qCtx *query_context.Context) bool {
+		return qCtx.ClientOpt() != nil
+	}),
+	"do": boolField(func(qCtx *query_context.Context) bool {
+		opt := qCtx.ClientOpt()
+		return opt != nil && opt.Do()
+	}),
+	"edns_udp_size": intField(func(qCtx *query_context.Context) (int, bool) {
+		opt := qCtx.ClientOpt()
+		if opt == nil {
+			return 0, false
+		}
+		return int(opt.UDPSize()), true
+	}, nil),
+
+	// server meta
+	"client_ip": {kind: kindIP, ip: func(qCtx *query_context.Context, f func(netip.Addr) bool) bool {
+		addr := qCtx.ServerMeta.ClientAddr
+		return addr.IsValid() && f(addr)
+	}},
+	"from_udp":    boolField(func(qCtx *query_context.Context) bool { return qCtx.ServerMeta.FromUDP }),
+	"server_name": strField(func(qCtx *query_context.Context) string { return qCtx.ServerMeta.ServerName }),
+	"url_path":    strField(func(qCtx *query_context.Context) string { return qCtx.ServerMeta.UrlPath }),
+
+	// response
+	"has_resp": boolField(func(qCtx *query_context.Context) bool { return qCtx.R() != nil }),
+	"rcode": intField(func(qCtx *query_context.Context) (int, bool) {
+		r := qCtx.R()
+		if r == nil {
+			return 0, false
+		}
+		return r.Rcode, true
+	}, rcodeNames),
+	"answer_count": intField(func(qCtx *query_context.Context) (int, bool) {
+		r := qCtx.R()
+		if r == nil {
+			return 0, false
+		}
+		return len(r.Answer), true
+	}, nil),
+	"min_ttl": intField(func(qCtx *query_context.Context) (int, bool) {
+		return answerTTL(qCtx, false)
+	}, nil),
+	"max_ttl": intField(func(qCtx *query_context.Context) (int, bool) {
+		return answerTTL(qCtx, true)
+	}, nil),
+	"resp_ip": {kind: kindIP, ip: func(qCtx *query_context.Context, f func(netip.Addr) bool) bool {
+		r := qCtx.R()
+		if r == nil {
+			return false
+		}
+		for _, rr := range r.Answer {
+			var addr netip.Addr
+			switch rr := rr.(type) {
+			case *dns.A:
+				addr, _ = netip.AddrFromSlice(rr.A.To4())
+			case *dns.AAAA:
+				addr, _ = netip.AddrFromSlice(rr.AAAA)
+			default:
+				continue
+			}
+			if addr.IsValid() && f(addr) {
+				return true
+			}
+		}
+		return false
+	}},
+	"cname": {kind: kindStr, domain: true, s: func(qCtx *query_context.Context, f func(string) bool) bool {
+		r := qCtx.R()
+		if r == nil {
+			return false
+		}
+		for _, rr := range r.Answer {
+			if c, ok := rr.(*dns.CNAME); ok && f(domain.NormalizeDomain(c.Target)) {
+				return true
+			}
+		}
+		return false
+	}},
+}
+
+// answerTTL returns the min or max ttl of answers.
+func answerTTL(qCtx *query_context.Context, useMax bool) (int, bool) {
+	r := qCtx.R()
+	if r == nil || len(r.Answer) == 0 {
+		return 0, false
+	}
+	ttl := r.Answer[0].Header().Ttl
+	for _, rr := range r.Answer[1:] {
+		if useMax {
+			ttl = max(ttl, rr.Header().Ttl)
+		} else {
+			ttl = min(ttl, rr.Header().Ttl)
+		}
+	}
+	return int(ttl), true
+}
+
+// funcs are boolean functions that take an uint32 argument.
+var funcs = map[string]func(qCtx *query_context.Context, n uint32) bool{
+	"mark": func(qCtx *query_context.Context, n uint32) bool {
+		return qCtx.HasMark(n)
+	},
+	"edns_opt": func(qCtx *query_context.Context, n uint32) bool {
+		opt := qCtx.ClientOpt()
+		if opt == nil {
+			return false
+		}
+		for _, o := range opt.Option {
+			if uint32(o.Option()) == n {
+				return true
+			}
+		}
+		return false
+	},
+}
@@ -0,0 +1,520 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/domain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+)
+
+// cond is a compiled expression.
+type cond func(qCtx *query_context.Context) bool
+
+type tokenKind int
+
+const (
+	tEOF    tokenKind = iota
+	tWord             // field, keyword, number or unquoted literal
+	tString           // quoted literal
+	tTag              // $tag
+	tOp               // || && ! == != < <= > >=
+	tLParen
+	tRParen
+	tLBrack
+	tRBrack
+	tComma
+)
+
+type token struct {
+	kind tokenKind
+	s    string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at %d", t.s, t.pos)
+}
+
+const specialChars = "()[],!=<>&|\"$"
+
+func isWordChar(c byte) bool {
+	return c > ' ' && !strings.ContainsRune(specialChars, rune(c))
+}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			v, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d, %w", i, err)
+			}
+			toks = append(toks, token{kind: tString, s: v, pos: i})
+			i = j + 1
+		case c == '$':
+			j := i + 1
+			for j < len(s) && isWordChar(s[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("missing tag at %d", i)
+			}
+			toks = append(toks, token{kind: tTag, s: s[i+1 : j], pos: i})
+			i = j
+		case strings.ContainsRune("()[],", rune(c)):
+			k := map[byte]tokenKind{'(': tLParen, ')': tRParen, '[': tLBrack, ']': tRBrack, ',': tComma}[c]
+			toks = append(toks, token{kind: k, s: s[i : i+1], pos: i})
+			i++
+		case strings.ContainsRune("!=<>&|", rune(c)):
+			op := s[i : i+1]
+			if i+1 < len(s) {
+				switch two := s[i : i+2]; two {
+				case "||", "&&", "==", "!=", "<=", ">=":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("invalid operator %q at %d", op, i)
+			}
+			toks = append(toks, token{kind: tOp, s: op, pos: i})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && isWordChar(s[j]) {
+				j++
+			}
+			toks = append(toks, token{kind: tWord, s: s[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(toks, token{kind: tEOF, pos: len(s)}), nil
+}
+
+type parser struct {
+	bq   sequence.BQ
+	toks []token
+	p    int
+}
+
+// compile compiles the expression s.
+func compile(bq sequence.BQ, s string) (cond, error) {
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 1 {
+		return nil, errors.New("empty expression")
+	}
+	p := &parser{bq: bq, toks: toks}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return c, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.p]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.p]
+	if t.kind != tEOF {
+		p.p++
+	}
+	return t
+}
+
+func (p *parser) expect(k tokenKind, s string) error {
+	if t := p.next(); t.kind != k {
+		return fmt.Errorf("expect %s, got %s", s, t)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (cond, error) {
+	c, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tOp && t.s == "||"; t = p.peek() {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := c
+		c = func(qCtx *query_context.Context) bool { return l(qCtx) || r(qCtx) }
+	}
+	return c, nil
+}
+
+func (p *parser) parseAnd() (cond, error) {
+	c, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t.kind == tOp && t.s == "&&"; t = p.peek() {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := c
+		c = func(qCtx *query_context.Context) bool { return l(qCtx) && r(qCtx) }
+	}
+	return c, nil
+}
+
+func (p *parser) parseUnary() (cond, error) {
+	if t := p.peek(); t.kind == tOp && t.s == "!" {
+		p.next()
+		c, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return not(c), nil
+	}
+	return p.parsePrimary()
+}
+
+func not(c cond) cond {
+	return func(qCtx *query_context.Context) bool { return !c(qCtx) }
+}
+
+func (p *parser) parsePrimary() (cond, error) {
+	t := p.next()
+	switch t.kind {
+	case tLParen:
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tRParen, ")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	case tWord:
+	default:
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+
+	switch t.s {
+	case "true", "false":
+		v := t.s == "true"
+		return func(_ *query_context.Context) bool { return v }, nil
+	}
+	if f, ok := funcs[t.s]; ok {
+		return p.parseFunc(t, f)
+	}
+	f, ok := fields[t.s]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s", t)
+	}
+	if f.kind == kindBool {
+		return f.b, nil
+	}
+
+	op := p.next()
+	switch {
+	case op.kind == tOp && op.s != "||" && op.s != "&&" && op.s != "!":
+	case op.kind == tWord && isWordOp(op.s):
+	default:
+		return nil, fmt.Errorf("expect an operator after %s, got %s", t.s, op)
+	}
+	operand, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	c, err := p.compileCmp(f, op.s, operand)
+	if err != nil {
+		return nil, fmt.Errorf("invalid comparison %s %s at %d, %w", t.s, op.s, t.pos, err)
+	}
+	return c, nil
+}
+
+func isWordOp(s string) bool {
+	switch s {
+	case "in", "prefix", "suffix", "contains", "regexp":
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseFunc(name token, f func(qCtx *query_context.Context, n uint32) bool) (cond, error) {
+	if err := p.expect(tLParen, "( after "+name.s); err != nil {
+		return nil, err
+	}
+	arg := p.next()
+	n, err := strconv.ParseUint(arg.s, 10, 32)
+	if arg.kind != tWord || err != nil {
+		return nil, fmt.Errorf("invalid argument of %s, expect an uint32, got %s", name.s, arg)
+	}
+	if err := p.expect(tRParen, ")"); err != nil {
+		return nil, err
+	}
+	v := uint32(n)
+	return func(qCtx *query_context.Context) bool { return f(qCtx, v) }, nil
+}
+
+// operand is the right side of a comparison. Either tag or values is set.
+type operand struct {
+	tag    string
+	values []string
+	list   bool
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tTag:
+		return operand{tag: t.s}, nil
+	case tWord, tString:
+		return operand{values: []string{t.s}}, nil
+	case tLBrack:
+		o := operand{list: true}
+		for {
+			v := p.next()
+			if v.kind != tWord && v.kind != tString {
+				return o, fmt.Errorf("expect a value in the list, got %s", v)
+			}
+			o.values = append(o.values, v.s)
+			sep := p.next()
+			if sep.kind == tRBrack {
+				return o, nil
+			}
+			if sep.kind != tComma {
+				return o, fmt.Errorf("expect , or ], got %s", sep)
+			}
+		}
+	default:
+		return operand{}, fmt.Errorf("expect a value, a list or a $tag, got %s", t)
+	}
+}
+
+func (p *parser) compileCmp(f *field, op string, o operand) (cond, error) {
+	if len(o.tag) > 0 && op != "in" {
+		return nil, errors.New("tags can only be used with in")
+	}
+	if o.list && op != "in" && f.kind != kindStr {
+		return nil, errors.New("lists can only be used with in")
+	}
+	if len(o.tag) > 0 && f.kind == kindInt {
+		return nil, errors.New("tags cannot be used with numbers")
+	}
+	if op == "!=" {
+		c, err := p.compileCmp(f, "==", o)
+		if err != nil {
+			return nil, err
+		}
+		return not(c), nil
+	}
+
+	switch f.kind {
+	case kindInt:
+		return compileInt(f, op, o.values)
+	case kindStr:
+		return p.compileStr(f, op, o)
+	case kindIP:
+		return p.compileIP(f, op, o)
+	default:
+		return nil, errors.New("invalid field")
+	}
+}
+
+func compileInt(f *field, op string, values []string) (cond, error) {
+	ns := make([]int, 0, len(values))
+	for _, s := range values {
+		if v, ok := f.names[strings.ToUpper(s)]; ok {
+			ns = append(ns, int(v))
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s", s)
+		}
+		ns = append(ns, n)
+	}
+	if len(ns) == 0 {
+		return nil, errors.New("missing value")
+	}
+	var match func(int) bool
+	n := ns[0]
+	switch op {
+	case "==", "in":
+		match = func(v int) bool {
+			for _, n := range ns {
+				if v == n {
+					return true
+				}
+			}
+			return false
+		}
+	case "<":
+		match = func(v int) bool { return v < n }
+	case "<=":
+		match = func(v int) bool { return v <= n }
+	case ">":
+		match = func(v int) bool { return v > n }
+	case ">=":
+		match = func(v int) bool { return v >= n }
+	default:
+		return nil, fmt.Errorf("invalid operator for numbers")
+	}
+	return func(qCtx *query_context.Context) bool { return f.i(qCtx, match) }, nil
+}
+
+func (p *parser) compileStr(f *field, op string, o operand) (cond, error) {
+	var match func(string) bool
+	switch op {
+	case "==", "in":
+		if len(o.tag) > 0 {
+			provider, _ := p.bq.M().GetPlugin(o.tag).(data_provider.DomainMatcherProvider)
+			if provider == nil {
+				return nil, fmt.Errorf("cannot find domain set %s", o.tag)
+			}
+			m := provider.GetDomainMatcher()
+			match = func(s string) bool {
+				_, ok := m.Match(s)
+				return ok
+			}
+			break
+		}
+		set := make(map[string]struct{}, len(o.values))
+		for _, s := range o.values {
+			if f.domain {
+				s = domain.NormalizeDomain(s)
+			}
+			set[s] = struct{}{}
+		}
+		match = func(s string) bool {
+			_, ok := set[s]
+			return ok
+		}
+	case "prefix", "suffix", "contains":
+		sf := map[string]func(s, sub string) bool{
+			"prefix":   strings.HasPrefix,
+			"suffix":   strings.HasSuffix,
+			"contains": strings.Contains,
+		}[op]
+		match = func(s string) bool {
+			for _, sub := range o.values {
+				if sf(s, sub) {
+					return true
+				}
+			}
+			return false
+		}
+	case "regexp":
+		var exps []*regexp.Regexp
+		for _, s := range o.values {
+			exp, err := regexp.Compile(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid reg expression, %w", err)
+			}
+			exps = append(exps, exp)
+		}
+		match = func(s string) bool {
+			for _, exp := range exps {
+				if exp.MatchString(s) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return nil, fmt.Errorf("invalid operator for strings")
+	}
+	return func(qCtx *query_context.Context) bool { return f.s(qCtx, match) }, nil
+}
+
+func (p *parser) compileIP(f *field, op string, o operand) (cond, error) {
+	if op != "==" && op != "in" {
+		return nil, fmt.Errorf("invalid operator for ips")
+	}
+	var match func(netip.Addr) bool
+	if len(o.tag) > 0 {
+		provider, _ := p.bq.M().GetPlugin(o.tag).(data_provider.IPMatcherProvider)
+		if provider == nil {
+			return nil, fmt.Errorf("cannot find ip set %s", o.tag)
+		}
+		m := provider.GetIPMatcher()
+		match = m.Match
+	} else {
+		prefixes := make([]netip.Prefix, 0, len(o.values))
+		for _, s := range o.values {
+			pfx, err := parsePrefix(s)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, pfx)
+		}
+		match = func(addr netip.Addr) bool {
+			addr = addr.Unmap()
+			for _, pfx := range prefixes {
+				if pfx.Contains(addr) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return func(qCtx *query_context.Context) bool { return f.ip(qCtx, match) }, nil
+}
+
+// parsePrefix parses an ip or a cidr.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
@@ -21,10 +21,12 @@ package tcp_server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -60,13 +62,60 @@ func (a *Args) init() {
 type HttpServer struct {
 	args *Args
 
-	server *http.Server
+	server  *http.Server
+	closed  atomic.Bool // StopAccepting or Close was called.
+	stopped atomic.Bool // serving goroutine exited.
+}
+
+var _ coremain.ReusablePlugin = (*HttpServer)(nil)
+var _ coremain.ServerPlugin = (*HttpServer)(nil)
+var _ coremain.HealthReporter = (*HttpServer)(nil)
+var _ coremain.AcceptStopper = (*HttpServer)(nil)
+
+// StopAccepting implements coremain.AcceptStopper.
+// It closes the listener and idle connections. Requests that are being
+// handled can still be responded until Close.
+func (s *HttpServer) StopAccepting() {
+	if s.server == nil { // dry run
+		return
+	}
+	s.closed.Store(true)
+	// Shutdown blocks until all requests are done. Close will stop it.
+	go s.server.Shutdown(context.Background())
 }
 
 func (s *HttpServer) Close() error {
+	if s.server == nil { // dry run
+		return nil
+	}
+	s.closed.Store(true)
 	return s.server.Close()
 }
 
+// ListenAddr implements coremain.ServerPlugin.
+func (s *HttpServer) ListenAddr() string {
+	return s.args.Listen
+}
+
+// Health implements coremain.HealthReporter.
+func (s *HttpServer) Health() error {
+	if s.stopped.Load() {
+		return server_utils.ErrNotServing
+	}
+	return nil
+}
+
+// ReuseIn implements coremain.ReusablePlugin.
+// The listener is kept, queries will be sent to the new entries.
+func (s *HttpServer) ReuseIn(bp *coremain.BP) error {
+	for _, entry := range s.args.Entries {
+		if err := server_utils.CheckEntry(bp, entry.Exec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -86,6 +135,15 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		mux.Handle(entry.Path, hh)
 	}
 
+	if bp.M().DryRun() {
+		if len(args.Key)+len(args.Cert) > 0 {
+			if err := server.LoadCert(new(tls.Config), args.Cert, args.Key); err != nil {
+				return nil, fmt.Errorf("failed to read tls cert, %w", err)
+			}
+		}
+		return &HttpServer{args: args}, nil
+	}
+
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
@@ -117,6 +175,10 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		return nil, fmt.Errorf("failed to setup http2 server, %w", err)
 	}
 
+	s := &HttpServer{
+		args:   args,
+		server: hs,
+	}
 	go func() {
 		var err error
 		if len(args.Key)+len(args.Cert) > 0 {
@@ -124,10 +186,10 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		} else {
 			err = hs.Serve(l)
 		}
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		s.stopped.Store(true)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &HttpServer{
-		args:   args,
-		server: hs,
-	}, nil
+	return s, nil
 }
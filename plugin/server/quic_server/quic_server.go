@@ -20,10 +20,13 @@
 package quic_server
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -52,14 +55,83 @@ func (a *Args) init() {
 	utils.SetDefaultNum(&a.IdleTimeout, 30)
 }
 
+// group tracks accepting quic servers. See server_utils.ReuseportGroup.
+var group server_utils.ReuseportGroup[*QuicServer]
+
 type QuicServer struct {
 	args *Args
 
-	l *quic.Listener
+	l         *quic.Listener
+	qt        *quic.Transport
+	uc        net.PacketConn
+	addr      string             // address of uc.
+	cancel    context.CancelFunc // cancels queries.
+	closed    atomic.Bool        // StopAccepting or Close was called.
+	stopped   atomic.Bool        // serving goroutine exited.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ coremain.ReusablePlugin = (*QuicServer)(nil)
+var _ coremain.ServerPlugin = (*QuicServer)(nil)
+var _ coremain.HealthReporter = (*QuicServer)(nil)
+var _ coremain.AcceptStopper = (*QuicServer)(nil)
+
+// StopAccepting implements coremain.AcceptStopper.
+// If another server took over the address (on reload), the socket is
+// closed, so the kernel no longer sends packets to it. Accepted
+// connections are closed as well, since they can not work without the
+// socket, clients will reconnect to the new server. Otherwise, it closes
+// the listener, accepted connections are kept until Close.
+func (s *QuicServer) StopAccepting() {
+	if s.l == nil { // dry run
+		return
+	}
+	s.closed.Store(true)
+	group.Leave(s.addr, s)
+	if _, ok := group.Last(s.addr); ok {
+		_ = s.closeAll()
+		return
+	}
+	_ = s.l.Close()
 }
 
 func (s *QuicServer) Close() error {
-	return s.l.Close()
+	if s.l == nil { // dry run
+		return nil
+	}
+	s.closed.Store(true)
+	group.Leave(s.addr, s)
+	s.cancel()
+	return s.closeAll()
+}
+
+func (s *QuicServer) closeAll() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.l.Close()
+		_ = s.qt.Close()
+		_ = s.uc.Close()
+	})
+	return s.closeErr
+}
+
+// ListenAddr implements coremain.ServerPlugin.
+func (s *QuicServer) ListenAddr() string {
+	return s.args.Listen
+}
+
+// Health implements coremain.HealthReporter.
+func (s *QuicServer) Health() error {
+	if s.stopped.Load() {
+		return server_utils.ErrNotServing
+	}
+	return nil
+}
+
+// ReuseIn implements coremain.ReusablePlugin.
+// The listener is kept, queries will be sent to the new entry.
+func (s *QuicServer) ReuseIn(bp *coremain.BP) error {
+	return server_utils.CheckEntry(bp, s.args.Entry)
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -84,7 +156,17 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 	tlsConfig.NextProtos = []string{"doq"}
 
-	uc, err := net.ListenPacket("udp", args.Listen)
+	if bp.M().DryRun() {
+		return &QuicServer{args: args}, nil
+	}
+
+	// SO_REUSEPORT allows a new server to bind the same address before
+	// the old one is closed on reload.
+	socketOpt := server_utils.ListenerSocketOpts{
+		SO_REUSEPORT: true,
+	}
+	lc := net.ListenConfig{Control: server_utils.ListenerControl(socketOpt)}
+	uc, err := lc.ListenPacket(context.Background(), "udp", args.Listen)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
@@ -119,14 +201,24 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &QuicServer{
+		args:   args,
+		l:      quicListener,
+		qt:     qt,
+		uc:     uc,
+		addr:   uc.LocalAddr().String(),
+		cancel: cancel,
+	}
+	group.Join(s.addr, s)
 	go func() {
 		defer quicListener.Close()
-		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout}
+		serverOpts := server.DoQServerOpts{Logger: bp.L(), IdleTimeout: idleTimeout, BaseContext: ctx}
 		err := server.ServeDoQ(quicListener, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		s.stopped.Store(true)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &QuicServer{
-		args: args,
-		l:    quicListener,
-	}, nil
+	return s, nil
 }
@@ -20,24 +20,102 @@
 package server_utils
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
 )
 
+// ErrNotServing is reported by servers whose listener stopped serving.
+var ErrNotServing = errors.New("listener is not serving")
+
+// NewHandler returns a server.Handler that sends queries to the entry.
+// The entry is looked up in the Mosdns that is currently serving. So
+// after a reload, queries go to the new entry with the same tag.
 func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
-	p := bp.M().GetPlugin(entry)
-	exec := sequence.ToExecutable(p)
+	entry = bp.M().ResolveTag(entry) // lookups after init have no namespace.
+	eh, err := newEntryHandler(bp.M(), bp.L(), entry)
+	if err != nil {
+		return nil, err
+	}
+	h := &handler{
+		m:      bp.M(),
+		logger: bp.L(),
+		entry:  entry,
+	}
+	h.cur.Store(eh)
+	return h, nil
+}
+
+// CheckEntry checks whether entry is a valid executable in bp.M().
+// Servers can use it to implement coremain.ReusablePlugin.
+func CheckEntry(bp *coremain.BP, entry string) error {
+	_, err := newEntryHandler(bp.M(), bp.L(), entry)
+	return err
+}
+
+type handler struct {
+	m      *coremain.Mosdns
+	logger *zap.Logger
+	entry  string
+	cur    atomic.Pointer[entryHandler]
+}
+
+type entryHandler struct {
+	m *coremain.Mosdns
+	h *server_handler.EntryHandler
+}
+
+func newEntryHandler(m *coremain.Mosdns, logger *zap.Logger, entry string) (*entryHandler, error) {
+	exec := sequence.ToExecutable(m.GetPlugin(entry))
 	if exec == nil {
 		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
 	}
 
 	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
+		Logger: logger,
 		Entry:  exec,
 	}
-	return server_handler.NewEntryHandler(handlerOpts), nil
+	return &entryHandler{m: m, h: server_handler.NewEntryHandler(handlerOpts)}, nil
+}
+
+func (h *handler) Handle(ctx context.Context, q *dns.Msg, meta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	eh := h.acquire()
+	defer eh.m.QueryFinished()
+	return eh.h.Handle(ctx, q, meta, packMsgPayload)
+}
+
+// acquire returns the entryHandler of the current Mosdns and
+// marks the query as started in it.
+func (h *handler) acquire() *entryHandler {
+	for {
+		eh := h.cur.Load()
+		if cur := h.m.Current(); cur != eh.m {
+			neh, err := newEntryHandler(cur, h.logger, h.entry)
+			if err != nil {
+				// The entry was removed by the reload. This server is
+				// going to be closed. Keep using the old entry.
+				eh.m.QueryStarted()
+				return eh
+			}
+			h.cur.CompareAndSwap(eh, neh)
+			continue
+		}
+
+		eh.m.QueryStarted()
+		// A reload may happen between Current() and QueryStarted().
+		// Check again, so the old plugins won't be closed while this
+		// query is using them.
+		if h.m.Current() == eh.m {
+			return eh
+		}
+		eh.m.QueryFinished()
+	}
 }
@@ -0,0 +1,69 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"slices"
+	"sync"
+)
+
+// ReuseportGroup tracks accepting servers by their socket addresses.
+// On reload, a new server binds the same address with SO_REUSEPORT before
+// the old one stops accepting. The kernel distributes queries to all
+// sockets of the address, so the old socket must be closed once it stops
+// accepting, or some queries will be lost. The old server can find the
+// new one here to send its remaining responses.
+type ReuseportGroup[T comparable] struct {
+	mu sync.Mutex
+	m  map[string][]T
+}
+
+// Join adds v to the group of addr.
+func (g *ReuseportGroup[T]) Join(addr string, v T) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.m == nil {
+		g.m = make(map[string][]T)
+	}
+	g.m[addr] = append(g.m[addr], v)
+}
+
+// Leave removes v from the group of addr. It is a noop if v is not in it.
+func (g *ReuseportGroup[T]) Leave(addr string, v T) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l := slices.DeleteFunc(g.m[addr], func(e T) bool { return e == v })
+	if len(l) == 0 {
+		delete(g.m, addr)
+	} else {
+		g.m[addr] = l
+	}
+}
+
+// Last returns the last joined member of addr.
+func (g *ReuseportGroup[T]) Last(addr string) (v T, ok bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	l := g.m[addr]
+	if len(l) == 0 {
+		return v, false
+	}
+	return l[len(l)-1], true
+}
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -56,13 +57,56 @@ func (a *Args) init() {
 type TcpServer struct {
 	args *Args
 
-	l net.Listener
+	l       net.Listener
+	cancel  context.CancelFunc // cancels queries.
+	closed  atomic.Bool        // StopAccepting or Close was called.
+	stopped atomic.Bool        // serving goroutine exited.
+}
+
+var _ coremain.ReusablePlugin = (*TcpServer)(nil)
+var _ coremain.ServerPlugin = (*TcpServer)(nil)
+var _ coremain.HealthReporter = (*TcpServer)(nil)
+var _ coremain.AcceptStopper = (*TcpServer)(nil)
+
+// StopAccepting implements coremain.AcceptStopper.
+// It closes the listener. Queries from accepted connections can still
+// be responded until Close.
+func (s *TcpServer) StopAccepting() {
+	if s.l == nil { // dry run
+		return
+	}
+	s.closed.Store(true)
+	_ = s.l.Close()
 }
 
 func (s *TcpServer) Close() error {
+	if s.l == nil { // dry run
+		return nil
+	}
+	s.closed.Store(true)
+	s.cancel()
 	return s.l.Close()
 }
 
+// ListenAddr implements coremain.ServerPlugin.
+func (s *TcpServer) ListenAddr() string {
+	return s.args.Listen
+}
+
+// Health implements coremain.HealthReporter.
+func (s *TcpServer) Health() error {
+	if s.stopped.Load() {
+		return server_utils.ErrNotServing
+	}
+	return nil
+}
+
+// ReuseIn implements coremain.ReusablePlugin.
+// The listener is kept, queries will be sent to the new entry.
+func (s *TcpServer) ReuseIn(bp *coremain.BP) error {
+	return server_utils.CheckEntry(bp, s.args.Entry)
+}
+
 func Init(bp *coremain.BP, args any) (any, error) {
 	return StartServer(bp, args.(*Args))
 }
@@ -82,6 +126,10 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 		}
 	}
 
+	if bp.M().DryRun() {
+		return &TcpServer{args: args}, nil
+	}
+
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
@@ -100,14 +148,24 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 	}
 	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &TcpServer{
+		args:   args,
+		l:      l,
+		cancel: cancel,
+	}
 	go func() {
 		defer l.Close()
-		serverOpts := server.TCPServerOpts{Logger: bp.L(), IdleTimeout: time.Duration(args.IdleTimeout) * time.Second}
+		serverOpts := server.TCPServerOpts{
+			Logger:      bp.L(),
+			IdleTimeout: time.Duration(args.IdleTimeout) * time.Second,
+			BaseContext: ctx,
+		}
 		err := server.ServeTCP(l, dh, serverOpts)
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		s.stopped.Store(true)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &TcpServer{
-		args: args,
-		l:    l,
-	}, nil
+	return s, nil
 }
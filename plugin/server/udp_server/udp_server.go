@@ -23,6 +23,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
@@ -46,14 +49,88 @@ func (a *Args) init() {
 	utils.SetDefaultString(&a.Listen, "127.0.0.1:53")
 }
 
+// group tracks accepting udp servers. See server_utils.ReuseportGroup.
+var group server_utils.ReuseportGroup[*UdpServer]
+
 type UdpServer struct {
 	args *Args
 
-	c net.PacketConn
+	c         *net.UDPConn
+	addr      string             // address of c.
+	cancel    context.CancelFunc // cancels queries.
+	closed    atomic.Bool        // StopAccepting or Close was called.
+	stopped   atomic.Bool        // serving goroutine exited.
+	detached  atomic.Bool        // c was closed by StopAccepting.
+	closeOnce sync.Once
+	closeErr  error
+}
+
+var _ coremain.ReusablePlugin = (*UdpServer)(nil)
+var _ coremain.ServerPlugin = (*UdpServer)(nil)
+var _ coremain.HealthReporter = (*UdpServer)(nil)
+var _ coremain.AcceptStopper = (*UdpServer)(nil)
+
+// StopAccepting implements coremain.AcceptStopper.
+// If another server took over the address (on reload), the socket is
+// closed, so the kernel no longer sends queries to it, and remaining
+// responses are sent via the new socket. Otherwise, it stops reading
+// from the socket, the socket is kept open for responses until Close.
+func (s *UdpServer) StopAccepting() {
+	if s.c == nil { // dry run
+		return
+	}
+	s.closed.Store(true)
+	group.Leave(s.addr, s)
+	if _, ok := group.Last(s.addr); ok {
+		s.detached.Store(true)
+		_ = s.closeConn()
+		return
+	}
+	_ = s.c.SetReadDeadline(time.Now())
 }
 
 func (s *UdpServer) Close() error {
-	return s.c.Close()
+	if s.c == nil { // dry run
+		return nil
+	}
+	s.closed.Store(true)
+	group.Leave(s.addr, s)
+	s.cancel()
+	return s.closeConn()
+}
+
+func (s *UdpServer) closeConn() error {
+	s.closeOnce.Do(func() { s.closeErr = s.c.Close() })
+	return s.closeErr
+}
+
+// responseConn returns the conn that responses are written to.
+func (s *UdpServer) responseConn() *net.UDPConn {
+	if s.detached.Load() {
+		if n, ok := group.Last(s.addr); ok {
+			return n.c
+		}
+	}
+	return s.c
+}
+
+// ListenAddr implements coremain.ServerPlugin.
+func (s *UdpServer) ListenAddr() string {
+	return s.args.Listen
+}
+
+// Health implements coremain.HealthReporter.
+func (s *UdpServer) Health() error {
+	if s.stopped.Load() {
+		return server_utils.ErrNotServing
+	}
+	return nil
+}
+
+// ReuseIn implements coremain.ReusablePlugin.
+// The socket is kept, queries will be sent to the new entry.
+func (s *UdpServer) ReuseIn(bp *coremain.BP) error {
+	return server_utils.CheckEntry(bp, s.args.Entry)
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
@@ -66,6 +143,10 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
 
+	if bp.M().DryRun() {
+		return &UdpServer{args: args}, nil
+	}
+
 	socketOpt := server_utils.ListenerSocketOpts{
 		SO_REUSEPORT: true,
 		SO_RCVBUF:    64 * 1024,
@@ -77,13 +158,22 @@ func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
 	}
 	bp.L().Info("udp server started", zap.Stringer("addr", c.LocalAddr()))
 
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &UdpServer{
+		args:   args,
+		c:      c.(*net.UDPConn),
+		addr:   c.LocalAddr().String(),
+		cancel: cancel,
+	}
+	group.Join(s.addr, s)
 	go func() {
-		defer c.Close()
-		err := server.ServeUDP(c.(*net.UDPConn), dh, server.UDPServerOpts{Logger: bp.L()})
-		bp.M().GetSafeClose().SendCloseSignal(err)
+		// c will be closed by s.Close().
+		serverOpts := server.UDPServerOpts{Logger: bp.L(), BaseContext: ctx, ResponseConn: s.responseConn}
+		err := server.ServeUDP(s.c, dh, serverOpts)
+		s.stopped.Store(true)
+		if !s.closed.Load() {
+			bp.M().GetSafeClose().SendCloseSignal(err)
+		}
 	}()
-	return &UdpServer{
-		args: args,
-		c:    c,
-	}, nil
+	return s, nil
 }
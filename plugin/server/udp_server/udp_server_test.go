@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package udp_server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
+	"github.com/miekg/dns"
+)
+
+const testConfig = `
+log: {level: error}
+drain_timeout: 5
+plugins:
+  - tag: main%d
+    type: sequence
+    args:
+      - exec: sleep %d
+      - exec: reject %d
+  - tag: server
+    type: udp_server
+    args: {entry: main%d, listen: "%s"}
+`
+
+// Queries must not be lost while the old server is being drained after
+// a reload.
+func TestUdpServer_reload(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().String()
+	_ = l.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	writeCfg := func(v, sleep, rcode int) {
+		// udp_server is not reused since its entry is changed.
+		if err := os.WriteFile(file, []byte(fmt.Sprintf(testConfig, v, sleep, rcode, v, addr)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCfg(1, 500, dns.RcodeNameError)
+	m, err := coremain.NewTestMosdnsFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+
+	exchange := func() (*dns.Msg, error) {
+		c := &dns.Client{Timeout: time.Second * 2}
+		r, _, err := c.Exchange(new(dns.Msg).SetQuestion("example.com.", dns.TypeA), addr)
+		return r, err
+	}
+
+	// A query that is being handled by the old server.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r, err := exchange()
+		if err != nil {
+			t.Errorf("in-flight query failed, %v", err)
+			return
+		}
+		if r.Rcode != dns.RcodeNameError {
+			t.Errorf("in-flight query should be answered by the old server, got rcode %d", r.Rcode)
+		}
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	writeCfg(2, 0, dns.RcodeRefused)
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old server is draining. Queries from different ports are
+	// distributed to all sockets of the address by the kernel.
+	for i := 0; i < 20; i++ {
+		r, err := exchange()
+		if err != nil {
+			t.Fatalf("query #%d during drain failed, %v", i, err)
+		}
+		if r.Rcode != dns.RcodeRefused {
+			t.Fatalf("query #%d should be answered by the new server, got rcode %d", i, r.Rcode)
+		}
+	}
+	wg.Wait()
+}
+
+// The server must not bind its socket in dry run mode.
+func TestUdpServer_checkConfig(t *testing.T) {
+	// Hold the address, so binding it again fails.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(fmt.Sprintf(testConfig, 1, 0, dns.RcodeRefused, 1, l.LocalAddr())), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if errs := coremain.CheckConfig(file); len(errs) != 0 {
+		t.Fatalf("CheckConfig() errors = %v", errs)
+	}
+}
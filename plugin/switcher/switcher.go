@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package switcher
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+)
+
+const PluginType = "switch"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+const (
+	valueOn  = "on"
+	valueOff = "off"
+)
+
+type Args struct {
+	// Values are the allowed values. Default is ["on", "off"].
+	Values []string `yaml:"values"`
+
+	// Default is the initial value. Default is "off" if Values is not
+	// set, otherwise it is the first value.
+	Default string `yaml:"default"`
+
+	// File, if set, persists the value. The value in the file overwrites
+	// Default on start. Without a file, the value is kept on reload only if
+	// the args are unchanged.
+	File string `yaml:"file"`
+}
+
+var _ sequence.QuickConfigurableMatch = (*Switch)(nil)
+var _ sequence.Matcher = (*Switch)(nil)
+var _ coremain.ReusablePlugin = (*Switch)(nil)
+
+// Switch is a value that can be changed via api at runtime.
+// As a matcher, "$tag v1 v2" matches if the value is one of v1, v2.
+// "$tag" is the same as "$tag on".
+type Switch struct {
+	values []string
+	file   string
+	logger *zap.Logger
+
+	v  atomic.Pointer[string]
+	mu sync.Mutex // serializes Set.
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	s, err := NewSwitch(args.(*Args), bp.L())
+	if err != nil {
+		return nil, err
+	}
+	bp.RegAPI(s.Api())
+	return s, nil
+}
+
+// ReuseIn implements coremain.ReusablePlugin.
+// The value is kept on reload.
+func (s *Switch) ReuseIn(bp *coremain.BP) error {
+	bp.RegAPI(s.Api())
+	return nil
+}
+
+// NewSwitch creates a Switch. If args.File exists, the value is loaded from it.
+func NewSwitch(args *Args, logger *zap.Logger) (*Switch, error) {
+	values := args.Values
+	if len(values) == 0 {
+		values = []string{valueOn, valueOff}
+		utils.SetDefaultString(&args.Default, valueOff)
+	}
+	utils.SetDefaultString(&args.Default, values[0])
+	if !slices.Contains(values, args.Default) {
+		return nil, fmt.Errorf("invalid default value %s", args.Default)
+	}
+
+	s := &Switch{values: values, file: args.File, logger: logger}
+	v := args.Default
+	if len(args.File) > 0 {
+		b, err := os.ReadFile(args.File)
+		switch {
+		case err == nil:
+			fv := string(bytes.TrimSpace(b))
+			if !slices.Contains(values, fv) {
+				return nil, fmt.Errorf("invalid value %s in file %s", fv, args.File)
+			}
+			v = fv
+		case errors.Is(err, os.ErrNotExist):
+		default:
+			return nil, fmt.Errorf("failed to read file, %w", err)
+		}
+	}
+	s.v.Store(&v)
+	return s, nil
+}
+
+// Value returns the current value.
+func (s *Switch) Value() string {
+	return *s.v.Load()
+}
+
+// Set changes the value. If there is a file, the value is written to it
+// first. The value is not changed if the write failed.
+func (s *Switch) Set(v string) error {
+	if !slices.Contains(s.values, v) {
+		return fmt.Errorf("invalid value %s, allowed values are %s", v, strings.Join(s.values, ", "))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.file) > 0 {
+		if err := writeFile(s.file, v); err != nil {
+			return fmt.Errorf("failed to persist value, %w", err)
+		}
+	}
+	old := s.v.Swap(&v)
+	if *old != v {
+		s.logger.Info("switch value changed", zap.String("from", *old), zap.String("to", v))
+	}
+	return nil
+}
+
+// writeFile writes v to a temp file then renames it to file, so a crash
+// will not leave an incomplete file.
+func writeFile(file, v string) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(v + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// Match matches if the value is "on".
+func (s *Switch) Match(_ context.Context, _ *query_context.Context) (bool, error) {
+	return s.Value() == valueOn, nil
+}
+
+// QuickConfigureMatch format: [value]...
+func (s *Switch) QuickConfigureMatch(args string) (sequence.Matcher, error) {
+	vs := strings.Fields(args)
+	if len(vs) == 0 {
+		if !slices.Contains(s.values, valueOn) {
+			return nil, errors.New("missing value")
+		}
+		return s, nil
+	}
+	for _, v := range vs {
+		if !slices.Contains(s.values, v) {
+			return nil, fmt.Errorf("invalid value %s", v)
+		}
+	}
+	return &valueMatcher{s: s, vs: vs}, nil
+}
+
+type valueMatcher struct {
+	s  *Switch
+	vs []string
+}
+
+func (m *valueMatcher) Match(_ context.Context, _ *query_context.Context) (bool, error) {
+	return slices.Contains(m.vs, m.s.Value()), nil
+}
+
+type valuePayload struct {
+	Value  string   `json:"value"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Api registers:
+//
+//	GET|PUT /    get or set the value, e.g. {"value":"on"}
+func (s *Switch) Api() *chi.Mux {
+	r := chi.NewRouter()
+	writeValue := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(valuePayload{Value: s.Value(), Values: s.values})
+	}
+	r.Get("/", func(w http.ResponseWriter, req *http.Request) {
+		writeValue(w)
+	})
+	r.Put("/", func(w http.ResponseWriter, req *http.Request) {
+		var p valuePayload
+		if err := json.NewDecoder(req.Body).Decode(&p); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body, %s", err), http.StatusBadRequest)
+			return
+		}
+		if !slices.Contains(s.values, p.Value) {
+			http.Error(w, fmt.Sprintf("invalid value %s", p.Value), http.StatusBadRequest)
+			return
+		}
+		if err := s.Set(p.Value); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeValue(w)
+	})
+	return r
+}
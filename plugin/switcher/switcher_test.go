@@ -0,0 +1,143 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package switcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+)
+
+func TestSwitch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "switch")
+	s, err := NewSwitch(&Args{Values: []string{"primary", "backup", "maintenance"}, File: file}, mlog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Value(); v != "primary" {
+		t.Fatalf("default value = %s, want primary", v)
+	}
+	if _, err := s.QuickConfigureMatch(""); err == nil {
+		t.Fatal("enum switch requires match values")
+	}
+	if _, err := s.QuickConfigureMatch("unknown"); err == nil {
+		t.Fatal("unknown match value should be rejected")
+	}
+	m, err := s.QuickConfigureMatch("backup maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := s.Api()
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put(`{"value":"unknown"}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid value, status = %d", code)
+	}
+	if ok, _ := m.Match(context.Background(), nil); ok {
+		t.Fatal("should not match primary")
+	}
+	if code := put(`{"value":"backup"}`); code != http.StatusOK {
+		t.Fatalf("status = %d", code)
+	}
+	if ok, _ := m.Match(context.Background(), nil); !ok {
+		t.Fatal("should match backup")
+	}
+
+	// Value is loaded from the file.
+	s, err = NewSwitch(&Args{Values: []string{"primary", "backup", "maintenance"}, File: file}, mlog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := s.Value(); v != "backup" {
+		t.Fatalf("persisted value = %s, want backup", v)
+	}
+}
+
+func TestSwitch_bool(t *testing.T) {
+	s, err := NewSwitch(&Args{}, mlog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Match(context.Background(), nil); ok {
+		t.Fatal("default should be off")
+	}
+	if err := s.Set("on"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Match(context.Background(), nil); !ok {
+		t.Fatal("should be on")
+	}
+	if err := s.Set("1"); err == nil {
+		t.Fatal("invalid value should be rejected")
+	}
+}
+
+func TestSwitch_reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	cfg := `
+log: {level: error}
+plugins:
+  - tag: sw
+    type: switch
+`
+	if err := os.WriteFile(file, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := coremain.NewTestMosdnsFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		m.GetSafeClose().SendCloseSignal(nil)
+		_ = m.GetSafeClose().WaitClosed()
+	}()
+
+	api := m.GetAPIRouter()
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, "/plugins/sw/", strings.NewReader(body)))
+		return w
+	}
+	if w := do(http.MethodPut, `{"value":"on"}`); w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+
+	if err := m.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.Current().GetPlugin("sw").(*Switch).Value(); v != valueOn {
+		t.Fatalf("value after reload = %s, want on", v)
+	}
+	w := do(http.MethodGet, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"on"`) {
+		t.Fatalf("api is not registered after reload, status = %d, body = %s", w.Code, w.Body)
+	}
+}
@@ -20,9 +20,12 @@
 package tools
 
 import (
+	"fmt"
+	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"os"
 	"strings"
 )
 
@@ -67,6 +70,68 @@ func newGenCmd() *cobra.Command {
 	return c
 }
 
+func newCheckCmd() *cobra.Command {
+	var cfg string
+	c := &cobra.Command{
+		Use:   "check [-c config_file]",
+		Args:  cobra.NoArgs,
+		Short: "Check a config file by building all its plugins without starting servers.",
+		Run: func(cmd *cobra.Command, args []string) {
+			errs := coremain.CheckConfig(cfg)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+			fmt.Println("config is valid")
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", "", "config file")
+	c.MarkFlagFilename("config")
+	return c
+}
+
+func newGraphCmd() *cobra.Command {
+	var (
+		cfg    string
+		format string
+	)
+	c := &cobra.Command{
+		Use:   "graph [-c config_file] [-f json|dot]",
+		Args:  cobra.NoArgs,
+		Short: "Print the plugin dependency graph of a config file.",
+		Run: func(cmd *cobra.Command, args []string) {
+			g, errs := coremain.BuildGraph(cfg)
+			for _, err := range errs {
+				fmt.Fprintln(os.Stderr, err)
+			}
+			if len(errs) > 0 {
+				os.Exit(1)
+			}
+
+			var err error
+			switch format {
+			case "json":
+				err = g.WriteJSON(os.Stdout)
+			case "dot":
+				err = g.WriteDOT(os.Stdout)
+			default:
+				err = fmt.Errorf("unsupported format %s", format)
+			}
+			if err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", "", "config file")
+	c.Flags().StringVarP(&format, "format", "f", "json", "output format, json or dot")
+	c.MarkFlagFilename("config")
+	return c
+}
+
 func convCfg(in, out string) error {
 	v := viper.New()
 	v.SetConfigFile(in)